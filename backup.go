@@ -0,0 +1,337 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	KEY_BACKUP_LOCK        = "/couchbase.com/backup/lock"
+	KEY_BACKUP_LAST        = "/couchbase.com/backup/last-success"
+	BACKUP_LOCK_TTL        = 3600 // seconds, in case the lock holder dies mid-backup
+	BACKUP_SET_TIME_FORMAT = "20060102T150405Z"
+	COUCHBASE_BIN_DIR      = "/opt/couchbase/bin"
+)
+
+// The last successful backup, as recorded in etcd under /couchbase.com/backup/last-success
+type BackupRecord struct {
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+	NodeIp string    `json:"nodeIp"`
+}
+
+// Back up the cluster by running cbbackup against liveNodeIp, writing
+// into a new timestamped set under dir.  Only the keep most recent sets
+// are kept.  Returns the path of the new backup set.
+func (c CouchbaseCluster) Backup(liveNodeIp, dir string, keep int) (string, error) {
+
+	c.logger().Infof("Backup() called with: %v", dir)
+
+	setDir := filepath.Join(dir, time.Now().UTC().Format(BACKUP_SET_TIME_FORMAT))
+
+	clusterUrl := fmt.Sprintf("http://%v:%v", liveNodeIp, c.LocalCouchbasePort)
+
+	cmd := exec.Command(
+		couchbaseToolPath("cbbackup"),
+		clusterUrl,
+		setDir,
+		"-u",
+		c.AdminUsername,
+		"-p",
+		c.AdminPassword,
+	)
+
+	output, err := cmd.CombinedOutput()
+	c.logger().Infof("cbbackup output: %v", string(output))
+	if err != nil {
+		// don't leave a half written set around for restore to pick up
+		os.RemoveAll(setDir)
+		return "", fmt.Errorf("cbbackup failed: %v", err)
+	}
+
+	record := BackupRecord{
+		Path:   setDir,
+		Time:   time.Now().UTC(),
+		NodeIp: liveNodeIp,
+	}
+	if err := c.setLastBackupEtcd(record); err != nil {
+		return "", err
+	}
+
+	if err := PruneBackupSets(dir, keep); err != nil {
+		return "", err
+	}
+
+	return setDir, nil
+
+}
+
+// Restore the backup set at setDir into bucket by running cbrestore
+// against liveNodeIp.
+func (c CouchbaseCluster) Restore(liveNodeIp, setDir, bucket string) error {
+
+	c.logger().Infof("Restore() called with: %v", setDir)
+
+	clusterUrl := fmt.Sprintf("http://%v:%v", liveNodeIp, c.LocalCouchbasePort)
+
+	cmd := exec.Command(
+		couchbaseToolPath("cbrestore"),
+		setDir,
+		clusterUrl,
+		"-u",
+		c.AdminUsername,
+		"-p",
+		c.AdminPassword,
+		"-b",
+		bucket,
+	)
+
+	output, err := cmd.CombinedOutput()
+	c.logger().Infof("cbrestore output: %v", string(output))
+	if err != nil {
+		return fmt.Errorf("cbrestore failed: %v", err)
+	}
+
+	return nil
+
+}
+
+// Get the backup sets in dir, oldest first.
+func ListBackupSets(dir string) ([]string, error) {
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	backupSets := []string{}
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(BACKUP_SET_TIME_FORMAT, fileInfo.Name()); err != nil {
+			continue
+		}
+		backupSets = append(backupSets, fileInfo.Name())
+	}
+
+	// the timestamp format sorts lexically in time order
+	sort.Strings(backupSets)
+
+	return backupSets, nil
+
+}
+
+// Remove all but the keep most recent backup sets in dir.
+func PruneBackupSets(dir string, keep int) error {
+
+	if keep <= 0 {
+		return nil
+	}
+
+	backupSets, err := ListBackupSets(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(backupSets) <= keep {
+		return nil
+	}
+
+	for _, backupSet := range backupSets[:len(backupSets)-keep] {
+		defaultLogger.Infof("Pruning backup set: %v", backupSet)
+		if err := os.RemoveAll(filepath.Join(dir, backupSet)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Try to grab the cluster-wide backup lock.  Returns false if someone else holds it.
+func (c CouchbaseCluster) AcquireBackupLock(owner string) (bool, error) {
+
+	_, err := c.etcdClient.Create(KEY_BACKUP_LOCK, owner, BACKUP_LOCK_TTL)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key already exists") {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+func (c CouchbaseCluster) ReleaseBackupLock(owner string) error {
+
+	_, err := c.etcdClient.CompareAndDelete(KEY_BACKUP_LOCK, owner, 0)
+	return err
+
+}
+
+// Find the last successful backup in etcd, or nil if there never was one.
+func (c CouchbaseCluster) LastBackupEtcd() (*BackupRecord, error) {
+
+	response, err := c.etcdClient.Get(KEY_BACKUP_LAST, false, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	record := &BackupRecord{}
+	if err := json.Unmarshal([]byte(response.Node.Value), record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+
+}
+
+func (c CouchbaseCluster) setLastBackupEtcd(record BackupRecord) error {
+
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.etcdClient.Set(KEY_BACKUP_LAST, string(recordJson), TTL_NONE)
+	return err
+
+}
+
+// Back up the cluster while holding the backup lock, so that only one
+// backup runs at a time.  Returns an empty path if someone else was
+// already running a backup.
+func (c CouchbaseCluster) BackupWithLock(liveNodeIp, owner, dir string, keep int) (string, error) {
+
+	locked, err := c.AcquireBackupLock(owner)
+	if err != nil {
+		return "", err
+	}
+	if !locked {
+		c.logger().Infof("Another backup is in progress, skipping")
+		return "", nil
+	}
+
+	defer func() {
+		if err := c.ReleaseBackupLock(owner); err != nil {
+			c.logger().Warnf("Failed to release backup lock: %v", err)
+		}
+	}()
+
+	return c.Backup(liveNodeIp, dir, keep)
+
+}
+
+// Periodically back up the cluster into c.BackupDir.  Every node runs this
+// loop, but a node only does a backup when the last successful backup
+// (by any node) is older than c.BackupInterval, and it can grab the lock.
+func (c CouchbaseCluster) BackupLoop() {
+
+	c.logger().Infof("BackupLoop() called with: %v every %v", c.BackupDir, c.BackupInterval)
+
+	for {
+
+		<-time.After(c.BackupInterval)
+
+		// this loop has its own copy of the credentials, so reload them in
+		// case they were rotated since the last backup
+		if _, err := c.ReloadAdminCredsEtcd(); err != nil {
+			c.logger().Warnf("Failed to reload admin credentials from etcd: %v", err)
+			continue
+		}
+
+		lastBackup, err := c.LastBackupEtcd()
+		if err != nil {
+			c.logger().Warnf("Failed to get last backup from etcd: %v", err)
+			continue
+		}
+		if lastBackup != nil && time.Since(lastBackup.Time) < c.BackupInterval {
+			c.logger().Infof("Last backup at %v is recent enough, skipping", lastBackup.Time)
+			continue
+		}
+
+		setDir, err := c.BackupWithLock(c.LocalCouchbaseIp, c.LocalCouchbaseIp, c.BackupDir, c.BackupKeep)
+		if err != nil {
+			c.logger().Warnf("Scheduled backup failed: %v", err)
+			continue
+		}
+		if setDir != "" {
+			c.logger().Infof("Scheduled backup written to: %v", setDir)
+		}
+
+	}
+
+}
+
+// Use the couchbase tool from the couchbase install if present, otherwise
+// rely on it being in the PATH.
+func couchbaseToolPath(tool string) string {
+
+	toolPath := filepath.Join(COUCHBASE_BIN_DIR, tool)
+	if _, err := os.Stat(toolPath); err == nil {
+		return toolPath
+	}
+	return tool
+
+}
+
+// Connect to etcd, find a live node and back it up into dir
+func RunBackup(etcdServers []string, dir string, keep int) (string, error) {
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(etcdServers)
+	if err != nil {
+		return "", err
+	}
+
+	owner, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	setDir, err := couchbaseCluster.BackupWithLock(liveNodeIp, owner, dir, keep)
+	if err != nil {
+		return "", err
+	}
+	if setDir == "" {
+		return "", fmt.Errorf("Another backup is in progress")
+	}
+
+	return setDir, nil
+
+}
+
+// Connect to etcd, find a live node and restore the backup set named
+// backupSet in dir into it.  If backupSet is empty, the latest set is used.
+func RunRestore(etcdServers []string, dir, backupSet, bucket string) error {
+
+	if backupSet == "" {
+		backupSets, err := ListBackupSets(dir)
+		if err != nil {
+			return err
+		}
+		if len(backupSets) == 0 {
+			return fmt.Errorf("No backup sets found in %v", dir)
+		}
+		backupSet = backupSets[len(backupSets)-1]
+	}
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(etcdServers)
+	if err != nil {
+		return err
+	}
+
+	return couchbaseCluster.Restore(liveNodeIp, filepath.Join(dir, backupSet), bucket)
+
+}
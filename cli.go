@@ -2,8 +2,11 @@ package cbcluster
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func IsCommandEnabled(arguments map[string]interface{}, commandKey string) bool {
@@ -18,20 +21,43 @@ func IsCommandEnabled(arguments map[string]interface{}, commandKey string) bool
 	return boolVal
 }
 
+// Load the --config file (if given) and the CBCLUSTER_* environment
+// variables, and make the result the config in effect.  Flags that are
+// extracted afterwards override it.
+func LoadConfigFromDocOpt(docOptParsed map[string]interface{}) error {
+
+	configPath, _ := ExtractStringArg(docOptParsed, "--config")
+
+	config, err := LoadConfig(configPath, os.Environ())
+	if err != nil {
+		return err
+	}
+
+	return SetConfig(config)
+
+}
+
 // convert from comma separated list to a string slice
 func ExtractEtcdServerList(docOptParsed map[string]interface{}) []string {
 
-	rawServerList, found := docOptParsed["--etcd-servers"]
+	return ExtractCommaSeparatedArg(docOptParsed, "--etcd-servers")
+
+}
+
+// convert from comma separated list to a string slice, or nil if missing
+func ExtractCommaSeparatedArg(docOptParsed map[string]interface{}, argToExtract string) []string {
+
+	rawList, found := docOptParsed[argToExtract]
 	if !found {
 		return nil
 	}
 
-	rawServerListStr, ok := rawServerList.(string)
+	rawListStr, ok := rawList.(string)
 	if !ok {
 		return nil
 	}
 
-	return strings.Split(rawServerListStr, ",")
+	return strings.Split(rawListStr, ",")
 
 }
 
@@ -39,6 +65,39 @@ func ExtractUserPass(docOptParsed map[string]interface{}) (string, error) {
 	return ExtractStringArg(docOptParsed, "--userpass")
 }
 
+// Get user:pass from --userpass, or else from the first line of the file
+// given by --userpass-file, which keeps the password out of ps and shell history.
+// Either way, the password is registered as a secret.
+func ExtractUserPassOrFile(docOptParsed map[string]interface{}) (string, error) {
+
+	if userpass, err := ExtractUserPass(docOptParsed); err == nil {
+		if _, password, err := parseUserPass(userpass); err == nil {
+			RegisterSecret(password)
+		}
+		return userpass, nil
+	}
+
+	userpassFile, err := ExtractStringArg(docOptParsed, "--userpass-file")
+	if err != nil {
+		return "", fmt.Errorf("Either --userpass or --userpass-file is required")
+	}
+
+	contents, err := ioutil.ReadFile(userpassFile)
+	if err != nil {
+		return "", err
+	}
+
+	userpass := strings.TrimRight(strings.SplitN(string(contents), "\n", 2)[0], "\r")
+	_, password, err := parseUserPass(userpass)
+	if err != nil {
+		return "", fmt.Errorf("Invalid userpass file %v: %v", userpassFile, err)
+	}
+	RegisterSecret(password)
+
+	return userpass, nil
+
+}
+
 func ExtractDockerTagOrLatest(docOptParsed map[string]interface{}) string {
 	dockerTag, err := ExtractStringArg(docOptParsed, "--docker-tag")
 	if err != nil || dockerTag == "" {
@@ -48,6 +107,23 @@ func ExtractDockerTagOrLatest(docOptParsed map[string]interface{}) string {
 
 }
 
+// Get --bucket, or the default bucket if it was not given
+func ExtractBucketOrDefault(docOptParsed map[string]interface{}) string {
+	bucket, err := ExtractStringArg(docOptParsed, "--bucket")
+	if err != nil || bucket == "" {
+		return DEFAULT_BUCKET_NAME
+	}
+	return bucket
+}
+
+func ExtractFleetEndpointOrDefault(docOptParsed map[string]interface{}) string {
+	fleetEndpoint, err := ExtractStringArg(docOptParsed, "--fleet-endpoint")
+	if err != nil || fleetEndpoint == "" {
+		return activeConfig.FleetEndpoint
+	}
+	return fleetEndpoint
+}
+
 func ExtractCbVersion(docOptParsed map[string]interface{}) (string, error) {
 	return ExtractStringArg(docOptParsed, "--version")
 }
@@ -73,6 +149,17 @@ func ExtractIntArg(docOptParsed map[string]interface{}, argToExtract string) (in
 
 }
 
+func ExtractDurationArg(docOptParsed map[string]interface{}, argToExtract string) (time.Duration, error) {
+
+	stringVal, err := ExtractStringArg(docOptParsed, argToExtract)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.ParseDuration(stringVal)
+
+}
+
 func ExtractStringArg(docOptParsed map[string]interface{}, argToExtract string) (string, error) {
 
 	rawVal, found := docOptParsed[argToExtract]
@@ -3,7 +3,6 @@ package cbcluster
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os/exec"
@@ -36,6 +35,7 @@ const (
 
 type CouchbaseCluster struct {
 	etcdClient                 *etcd.Client
+	Logger                     Logger // if nil, use the default logger
 	LocalCouchbaseIp           string
 	LocalCouchbasePort         string
 	LocalCouchbaseVersion      string
@@ -44,18 +44,33 @@ type CouchbaseCluster struct {
 	defaultBucketRamQuotaMB    string
 	defaultBucketReplicaNumber string
 	EtcdServers                []string
+	DesignDocDir               string // if empty, design docs are loaded from etcd
+	BackupDir                  string // if empty, no scheduled backups are done
+	BackupInterval             time.Duration
+	BackupKeep                 int
+	SeedDataPath               string // if empty, no seed data is loaded
+	SeedBucket                 string
+	SeedBucketPassword         string
+	MetricsAddr                string         // if empty, no metrics are served
+	HealthAddr                 string         // if empty, no /healthz and /readyz are served
+	ServiceManager             ServiceManager // if nil, the one named by service_manager in the config
+	metrics                    *NodeMetrics
 }
 
 func NewCouchbaseCluster(etcdServers []string) *CouchbaseCluster {
 
 	c := &CouchbaseCluster{}
 
+	if len(etcdServers) == 0 {
+		etcdServers = activeConfig.EtcdServers
+	}
+
 	if len(etcdServers) > 0 {
 		c.EtcdServers = etcdServers
-		log.Printf("Connect to explict etcd servers: %v", c.EtcdServers)
+		defaultLogger.Infof("Connect to explict etcd servers: %v", c.EtcdServers)
 	} else {
 		c.EtcdServers = []string{}
-		log.Printf("Connect to etcd on localhost")
+		defaultLogger.Infof("Connect to etcd on localhost")
 	}
 	c.ConnectToEtcd()
 	return c
@@ -74,9 +89,18 @@ func (c *CouchbaseCluster) StartCouchbaseNode() error {
 		return fmt.Errorf("You must define LocalCouchbaseIp before calling")
 	}
 
-	c.LocalCouchbasePort = LOCAL_COUCHBASE_PORT
-	c.defaultBucketRamQuotaMB = DEFAULT_BUCKET_RAM_MB
-	c.defaultBucketReplicaNumber = DEFAULT_BUCKET_REPLICA_NUMBER
+	c.LocalCouchbasePort = activeConfig.CouchbasePort
+	c.defaultBucketRamQuotaMB = strconv.Itoa(activeConfig.DefaultBucketRamMB)
+	c.defaultBucketReplicaNumber = strconv.Itoa(activeConfig.DefaultBucketReplicaNumber)
+
+	c.Logger = c.logger().With("node", c.LocalCouchbaseIp, "phase", NODE_LIFECYCLE_STARTING)
+
+	c.metrics = NewNodeMetrics()
+	if err := c.startAgentListeners(); err != nil {
+		return err
+	}
+
+	c.RecordEvent(EVENT_CREDENTIALS_LOADED, "Node daemon starting with the admin credentials of user %v", c.AdminUsername)
 
 	success, err := c.BecomeFirstClusterNode()
 	if err != nil {
@@ -87,7 +111,23 @@ func (c *CouchbaseCluster) StartCouchbaseNode() error {
 		return err
 	}
 
-	if err := StartCouchbaseService(); err != nil {
+	if c.ServiceManager == nil {
+		serviceManager, err := NewServiceManager(activeConfig.ServiceManager)
+		if err != nil {
+			return err
+		}
+		c.ServiceManager = serviceManager
+	}
+
+	// this only returns on failure, and a couchbase run by the daemon
+	// itself must not outlive it
+	defer func() {
+		if err := c.ServiceManager.Stop(); err != nil {
+			c.logger().Warnf("Failed to stop couchbase: %v", err)
+		}
+	}()
+
+	if err := StartCouchbaseService(c.ServiceManager); err != nil {
 		return err
 	}
 
@@ -97,7 +137,8 @@ func (c *CouchbaseCluster) StartCouchbaseNode() error {
 
 	switch success {
 	case true:
-		log.Printf("We became first cluster node, init cluster and bucket")
+		c.logger().Infof("We became first cluster node, init cluster and bucket")
+		c.setLifecycleState(NODE_LIFECYCLE_INITIALIZING)
 
 		if err := c.ClusterInit(); err != nil {
 			return err
@@ -105,21 +146,36 @@ func (c *CouchbaseCluster) StartCouchbaseNode() error {
 		if err := c.CreateDefaultBucket(); err != nil {
 			return err
 		}
+		if err := c.ApplyInitialDesignDocs(); err != nil {
+			return err
+		}
+		if c.SeedDataPath != "" {
+			if err := c.LoadInitialSeedData(); err != nil {
+				return err
+			}
+		}
+		c.RecordEvent(EVENT_INITIALIZED, "Initialized the cluster and the default bucket")
 	case false:
+		c.setLifecycleState(NODE_LIFECYCLE_JOINING)
 		if err := c.JoinExistingCluster(); err != nil {
 			return err
 		}
+		c.RecordEvent(EVENT_JOINED, "Joined the cluster")
 	}
 
-	c.EventLoop()
+	c.setLifecycleState(NODE_LIFECYCLE_RUNNING)
+
+	if c.BackupDir != "" && c.BackupInterval > 0 {
+		go c.BackupLoop()
+	}
 
-	return fmt.Errorf("Event loop died") // should never get here
+	return c.EventLoop()
 
 }
 
 func (c CouchbaseCluster) BecomeFirstClusterNode() (bool, error) {
 
-	log.Printf("BecomeFirstClusterNode()")
+	c.logger().Infof("BecomeFirstClusterNode()")
 
 	// since we don't knoow how long it will be until we go
 	// into the event loop, set TTL to 0 (infinite) for now.
@@ -128,17 +184,18 @@ func (c CouchbaseCluster) BecomeFirstClusterNode() (bool, error) {
 	if err != nil {
 		// expected error where someone beat us out
 		if strings.Contains(err.Error(), "Key already exists") {
-			log.Printf("Key %v already exists", KEY_NODE_STATE)
+			c.logger().Infof("Key %v already exists", KEY_NODE_STATE)
 			return false, nil
 		}
 
 		// otherwise, unexpected error
-		log.Printf("Unexpected error: %v", err)
+		c.logger().Warnf("Unexpected error: %v", err)
 		return false, err
 	}
 
 	// no error must mean that were were able to create the key
-	log.Printf("Created key: %v", KEY_NODE_STATE)
+	c.logger().Infof("Created key: %v", KEY_NODE_STATE)
+	c.RecordEvent(EVENT_BECAME_FIRST_NODE, "Created %v, this node will initialize the cluster", KEY_NODE_STATE)
 	return true, nil
 
 }
@@ -147,20 +204,20 @@ func (c CouchbaseCluster) BecomeFirstClusterNode() (bool, error) {
 // the first node that is up
 func (c CouchbaseCluster) JoinExistingCluster() error {
 
-	log.Printf("JoinExistingCluster() called")
+	c.logger().Infof("JoinExistingCluster() called")
 
 	sleepSeconds := 0
 
-	for i := 0; i < MAX_RETRIES_JOIN_CLUSTER; i++ {
+	for i := 0; i < activeConfig.MaxRetriesJoinCluster; i++ {
 
-		log.Printf("Calling FindLiveNode()")
+		c.logger().Infof("Calling FindLiveNode()")
 
 		liveNodeIp, err := c.FindLiveNode()
 		if err != nil {
-			log.Printf("FindLiveNode returned err: %v.  Trying again", err)
+			c.logger().Warnf("FindLiveNode returned err: %v.  Trying again", err)
 		}
 
-		log.Printf("liveNodeIp: %v", liveNodeIp)
+		c.logger().Infof("liveNodeIp: %v", liveNodeIp)
 
 		if liveNodeIp != "" {
 			return c.JoinLiveNode(liveNodeIp)
@@ -168,7 +225,7 @@ func (c CouchbaseCluster) JoinExistingCluster() error {
 
 		sleepSeconds += 10
 
-		log.Printf("Sleeping for %v", sleepSeconds)
+		c.logger().Infof("Sleeping for %v", sleepSeconds)
 
 		<-time.After(time.Second * time.Duration(sleepSeconds))
 
@@ -191,19 +248,19 @@ func (c CouchbaseCluster) FindLiveNode() (string, error) {
 
 	node := response.Node
 
-	log.Printf("node: %+v", node)
+	c.logger().Infof("node: %+v", node)
 
 	if node == nil {
-		log.Printf("node is nil, returning")
+		c.logger().Infof("node is nil, returning")
 		return "", nil
 	}
 
 	if len(node.Nodes) == 0 {
-		log.Printf("len(node.Nodes) == 0, returning")
+		c.logger().Infof("len(node.Nodes) == 0, returning")
 		return "", nil
 	}
 
-	log.Printf("node.Nodes: %+v", node.Nodes)
+	c.logger().Infof("node.Nodes: %+v", node.Nodes)
 
 	for _, subNode := range node.Nodes {
 
@@ -211,7 +268,7 @@ func (c CouchbaseCluster) FindLiveNode() (string, error) {
 		// only want the last element in the path
 		_, subNodeIp := path.Split(subNode.Key)
 
-		log.Printf("subNodeIp: %v", subNodeIp)
+		c.logger().Infof("subNodeIp: %v", subNodeIp)
 
 		return subNodeIp, nil
 	}
@@ -220,9 +277,43 @@ func (c CouchbaseCluster) FindLiveNode() (string, error) {
 
 }
 
+// Get the child nodes of the etcd directory at key.  If the key does
+// not exist, an empty list is returned.
+func (c CouchbaseCluster) etcdChildren(key string) (etcd.Nodes, error) {
+
+	response, err := c.etcdClient.Get(key, false, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key not found") {
+			return etcd.Nodes{}, nil
+		}
+		return nil, err
+	}
+
+	return response.Node.Nodes, nil
+
+}
+
+// Get the ips of all the nodes that have published their state in etcd.
+func (c CouchbaseCluster) FindLiveNodes() ([]string, error) {
+
+	nodes, err := c.etcdChildren(KEY_NODE_STATE)
+	if err != nil {
+		return nil, err
+	}
+
+	liveNodeIps := []string{}
+	for _, node := range nodes {
+		_, nodeIp := path.Split(node.Key)
+		liveNodeIps = append(liveNodeIps, nodeIp)
+	}
+
+	return liveNodeIps, nil
+
+}
+
 func (c *CouchbaseCluster) FetchClusterDetails() error {
 
-	for i := 0; i < MAX_RETRIES_JOIN_CLUSTER; i++ {
+	for i := 0; i < activeConfig.MaxRetriesJoinCluster; i++ {
 
 		endpointUrl := fmt.Sprintf(
 			"http://%v:%v/pools",
@@ -232,7 +323,7 @@ func (c *CouchbaseCluster) FetchClusterDetails() error {
 
 		jsonMap := map[string]interface{}{}
 		if err := c.getJsonData(endpointUrl, &jsonMap); err != nil {
-			log.Printf("Got error %v trying to fetch details.  Assume that the cluster is not up yet, sleeping and will retry", err)
+			c.logger().Infof("Got error %v trying to fetch details.  Assume that the cluster is not up yet, sleeping and will retry", err)
 			<-time.After(time.Second * 10)
 			continue
 		}
@@ -243,7 +334,7 @@ func (c *CouchbaseCluster) FetchClusterDetails() error {
 			return fmt.Errorf("Expected implementationVersion to contain a string")
 		}
 
-		log.Printf("Version: %v", versionStr)
+		c.logger().Infof("Version: %v", versionStr)
 		c.LocalCouchbaseVersion = versionStr
 
 		return nil
@@ -256,20 +347,20 @@ func (c *CouchbaseCluster) FetchClusterDetails() error {
 
 func (c CouchbaseCluster) WaitForRestService() error {
 
-	for i := 0; i < MAX_RETRIES_START_COUCHBASE; i++ {
+	for i := 0; i < activeConfig.MaxRetriesStartCouchbase; i++ {
 
 		endpointUrl := fmt.Sprintf("http://%v:%v/", c.LocalCouchbaseIp, c.LocalCouchbasePort)
-		log.Printf("Waiting for REST service at %v to be up", endpointUrl)
+		c.logger().Infof("Waiting for REST service at %v to be up", endpointUrl)
 		resp, err := http.Get(endpointUrl)
 		if err == nil {
 			defer resp.Body.Close()
 			if resp.StatusCode == 200 {
-				log.Printf("REST service appears to be up")
+				c.logger().Infof("REST service appears to be up")
 				return nil
 			}
 		}
 
-		log.Printf("Not up yet, sleeping and will retry")
+		c.logger().Infof("Not up yet, sleeping and will retry")
 		<-time.After(time.Second * 10)
 
 	}
@@ -283,7 +374,7 @@ func (c CouchbaseCluster) WaitForRestService() error {
 // when /opt/couchbase/var is mounted as a volume, which presumably starts out empty.
 func PrepareVarDirectory() error {
 
-	log.Printf("PrepareVarDirectory()")
+	defaultLogger.Infof("PrepareVarDirectory()")
 
 	cmd := exec.Command(
 		"mkdir",
@@ -298,7 +389,7 @@ func PrepareVarDirectory() error {
 	cmd.Dir = "/opt/couchbase/var"
 
 	output, err := cmd.CombinedOutput()
-	log.Printf("mkdir output: %v", output)
+	defaultLogger.Infof("mkdir output: %v", output)
 	if err != nil {
 		return err
 	}
@@ -310,7 +401,7 @@ func PrepareVarDirectory() error {
 		"/opt/couchbase/var",
 	)
 	output, err = cmd.CombinedOutput()
-	log.Printf("chown output: %v", output)
+	defaultLogger.Infof("chown output: %v", output)
 	if err != nil {
 		return err
 	}
@@ -319,55 +410,6 @@ func PrepareVarDirectory() error {
 
 }
 
-func StartCouchbaseService() error {
-
-	log.Printf("StartCouchbaseService()")
-
-	for i := 0; i < MAX_RETRIES_START_COUCHBASE; i++ {
-
-		// call "service couchbase-server start"
-		cmd := exec.Command("service", "couchbase-server", "start")
-
-		if err := cmd.Run(); err != nil {
-			log.Printf("Running command returned error: %v", err)
-			return err
-		}
-
-		running, err := CouchbaseServiceRunning()
-		if err != nil {
-			return err
-		}
-		if running {
-			log.Printf("Couchbase service running")
-			return nil
-		}
-
-		log.Printf("Couchbase service not running, sleep and try again")
-
-		<-time.After(time.Second * 10)
-
-	}
-
-	return fmt.Errorf("Unable to start couchbase service after several retries")
-
-}
-
-func CouchbaseServiceRunning() (bool, error) {
-
-	cmd := exec.Command("service", "couchbase-server", "status")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// service x status returns a non-zero exit code if
-		// the service is not running, which causes cmd.CombinedOutput
-		// to return an error.   however, absorb the error and turn it
-		// into a "not running" signal rather than propagating an error.
-		return false, nil
-	}
-	log.Printf("Checking status returned output: %v", string(output))
-
-	return strings.Contains(string(output), "is running"), nil
-}
-
 // Set the username and password for the cluster.  The same as calling:
 // $ couchbase-cli cluster-init ..
 //
@@ -413,7 +455,7 @@ func (c CouchbaseCluster) SetClusterRam() error {
 
 	ramMb, err := CalculateClusterRam()
 	if err != nil {
-		log.Printf("Warning, failed to calculate cluster ram: %v.  Default to 1024 MB", err)
+		c.logger().Warnf("Warning, failed to calculate cluster ram: %v.  Default to 1024 MB", err)
 		ramMb = "1024"
 	}
 
@@ -423,7 +465,7 @@ func (c CouchbaseCluster) SetClusterRam() error {
 		"memoryQuota": {ramMb},
 	}
 
-	log.Printf("Attempting to set cluster ram to: %v MB", ramMb)
+	c.logger().Infof("Attempting to set cluster ram to: %v MB", ramMb)
 
 	return c.POST(false, endpointUrl, data)
 
@@ -435,7 +477,7 @@ func CalculateClusterRam() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	log.Printf("Total RAM (MB) on machine: %v", totalRamMb)
+	defaultLogger.Infof("Total RAM (MB) on machine: %v", totalRamMb)
 	clusterRam := (totalRamMb * 75) / 100
 	return fmt.Sprintf("%v", clusterRam), nil
 
@@ -482,14 +524,14 @@ func CalculateTotalRam() (int, error) {
 
 func (c CouchbaseCluster) CreateDefaultBucket() error {
 
-	log.Printf("CreateDefaultBucket()")
+	c.logger().Infof("CreateDefaultBucket()")
 
 	hasDefaultBucket, err := c.HasDefaultBucket()
 	if err != nil {
 		return err
 	}
 	if hasDefaultBucket {
-		log.Printf("Default bucket already exists, nothing to do")
+		c.logger().Infof("Default bucket already exists, nothing to do")
 		return nil
 	}
 
@@ -509,7 +551,7 @@ func (c CouchbaseCluster) CreateDefaultBucket() error {
 
 func (c CouchbaseCluster) HasDefaultBucket() (bool, error) {
 
-	log.Printf("HasDefaultBucket()")
+	c.logger().Infof("HasDefaultBucket()")
 
 	endpointUrl := fmt.Sprintf(
 		"http://%v:%v/pools/default/buckets",
@@ -542,9 +584,67 @@ func (c CouchbaseCluster) HasDefaultBucket() (bool, error) {
 
 }
 
+// Wait until bucket exists and reports all of its nodes as healthy, which
+// is needed before it can serve views or documents.
+func (c CouchbaseCluster) WaitUntilBucketReady(liveNodeIp, bucket string) error {
+
+	c.logger().Infof("WaitUntilBucketReady() called with: %v", bucket)
+
+	worker := func() (bool, error) {
+		return c.checkBucketReady(liveNodeIp, bucket)
+	}
+
+	sleeper := func(numAttempts int) (bool, int) {
+		if numAttempts > activeConfig.MaxRetriesJoinCluster {
+			return false, -1
+		}
+		return true, 5
+	}
+
+	return RetryLoop(worker, sleeper)
+
+}
+
+// Check once whether the bucket exists and all of its nodes are healthy
+func (c CouchbaseCluster) checkBucketReady(liveNodeIp, bucket string) (bool, error) {
+
+	endpointUrl := fmt.Sprintf(
+		"http://%v:%v/pools/default/buckets/%v",
+		liveNodeIp,
+		c.LocalCouchbasePort,
+		bucket,
+	)
+
+	jsonMap := map[string]interface{}{}
+	if err := c.getJsonData(endpointUrl, &jsonMap); err != nil {
+		c.logger().Infof("Bucket %v not ready yet: %v", bucket, err)
+		return false, nil
+	}
+
+	nodes, ok := jsonMap["nodes"].([]interface{})
+	if !ok || len(nodes) == 0 {
+		c.logger().Infof("Bucket %v has no nodes yet", bucket)
+		return false, nil
+	}
+
+	for _, node := range nodes {
+		nodeMap, ok := node.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("Node had unexpected data type")
+		}
+		if nodeMap["status"] != "healthy" {
+			c.logger().Infof("Bucket %v node status: %v", bucket, nodeMap["status"])
+			return false, nil
+		}
+	}
+
+	return true, nil
+
+}
+
 func (c CouchbaseCluster) JoinLiveNode(liveNodeIp string) error {
 
-	log.Printf("JoinLiveNode() called with %v", liveNodeIp)
+	c.logger().Infof("JoinLiveNode() called with %v", liveNodeIp)
 
 	inCluster, err := c.CheckIfInClusterAndHealthy(liveNodeIp)
 	if err != nil {
@@ -568,17 +668,24 @@ func (c CouchbaseCluster) JoinLiveNode(liveNodeIp string) error {
 		return err
 	}
 
+	// record how the rebalance ends, without holding up the daemon
+	go func() {
+		if err := c.WaitUntilRebalanceFinished(liveNodeIp); err != nil {
+			c.logger().Warnf("Rebalance after joining did not finish cleanly: %v", err)
+		}
+	}()
+
 	return nil
 }
 
 func (c CouchbaseCluster) CheckIfInClusterAndHealthy(liveNodeIp string) (bool, error) {
 
-	log.Printf("CheckIfInCluster()")
+	c.logger().Infof("CheckIfInCluster()")
 	nodes, err := c.GetClusterNodes(liveNodeIp)
 	if err != nil {
 		return false, err
 	}
-	log.Printf("CheckIfInCluster nodes: %+v", nodes)
+	c.logger().Infof("CheckIfInCluster nodes: %+v", nodes)
 
 	for _, node := range nodes {
 
@@ -589,7 +696,7 @@ func (c CouchbaseCluster) CheckIfInClusterAndHealthy(liveNodeIp string) (bool, e
 
 		hostname := nodeMap["hostname"] // ex: "10.231.192.180:8091"
 		hostnameStr, ok := hostname.(string)
-		log.Printf("CheckIfInCluster, hostname: %v", hostnameStr)
+		c.logger().Infof("CheckIfInCluster, hostname: %v", hostnameStr)
 
 		if !ok {
 			return false, fmt.Errorf("No hostname string found")
@@ -602,16 +709,16 @@ func (c CouchbaseCluster) CheckIfInClusterAndHealthy(liveNodeIp string) (bool, e
 				return false, fmt.Errorf("No status string found")
 			}
 			if statusStr == "healthy" {
-				log.Printf("CheckIfInCluster returning true")
+				c.logger().Infof("CheckIfInCluster returning true")
 				return true, nil
 			} else {
-				log.Printf("%v in cluster, but status not healthy.  Status: %v", c.LocalCouchbaseIp, statusStr)
+				c.logger().Infof("%v in cluster, but status not healthy.  Status: %v", c.LocalCouchbaseIp, statusStr)
 			}
 
 		}
 	}
 
-	log.Printf("CheckIfInCluster returning false")
+	c.logger().Infof("CheckIfInCluster returning false")
 	return false, nil
 }
 
@@ -619,14 +726,14 @@ func (c CouchbaseCluster) CheckIfInClusterAndHealthy(liveNodeIp string) (bool, e
 // To check all nodes without specifying a specific number of nodes, pass -1 for numNodes.
 func (c CouchbaseCluster) CheckNumNodesClusterHealthy(numNodes int, liveNodeIp string) (bool, error) {
 
-	log.Printf("CheckNumNodesClusterHealthy()")
+	c.logger().Infof("CheckNumNodesClusterHealthy()")
 	nodes, err := c.GetClusterNodes(liveNodeIp)
 	if err != nil {
 		return false, err
 	}
 
 	if numNodes != -1 && len(nodes) < numNodes {
-		log.Printf("Not enough nodes are up.  Expected %v, got %v", numNodes, len(nodes))
+		c.logger().Infof("Not enough nodes are up.  Expected %v, got %v", numNodes, len(nodes))
 		return false, nil
 	}
 
@@ -643,17 +750,44 @@ func (c CouchbaseCluster) CheckNumNodesClusterHealthy(numNodes int, liveNodeIp s
 			return false, fmt.Errorf("No status string found")
 		}
 		if statusStr != "healthy" {
-			log.Printf("node %+v status not healthy.  Status: %v", nodeMap, statusStr)
+			c.logger().Infof("node %+v status not healthy.  Status: %v", nodeMap, statusStr)
 			return false, nil
 		}
 
 	}
 
-	log.Printf("All cluster nodes appear to be healthy")
+	c.logger().Infof("All cluster nodes appear to be healthy")
 	return true, nil
 
 }
 
+// Count the nodes that are healthy and active members of the cluster, which
+// excludes nodes that were added but not rebalanced in yet.  Connect to liveNodeIp.
+func (c CouchbaseCluster) CountActiveHealthyNodes(liveNodeIp string) (int, error) {
+
+	nodes, err := c.GetClusterNodes(liveNodeIp)
+	if err != nil {
+		return -1, err
+	}
+
+	numActiveHealthy := 0
+	for _, node := range nodes {
+
+		nodeMap, ok := node.(map[string]interface{})
+		if !ok {
+			return -1, fmt.Errorf("Node had unexpected data type")
+		}
+
+		if nodeMap["status"] == "healthy" && nodeMap["clusterMembership"] == "active" {
+			numActiveHealthy += 1
+		}
+
+	}
+
+	return numActiveHealthy, nil
+
+}
+
 // Check if all nodes in the cluster are healthy.  Connect to liveNodeIp.
 func (c CouchbaseCluster) CheckAllNodesClusterHealthy(liveNodeIp string) (bool, error) {
 
@@ -664,14 +798,14 @@ func (c CouchbaseCluster) CheckAllNodesClusterHealthy(liveNodeIp string) (bool,
 // Based on docs: http://docs.couchbase.com/couchbase-manual-2.5/cb-rest-api/#rebalancing-nodes
 func (c CouchbaseCluster) TriggerRebalance(liveNodeIp string) error {
 
-	log.Printf("TriggerRebalance()")
+	c.logger().Infof("TriggerRebalance()")
 
 	otpNodeList, err := c.OtpNodeList(liveNodeIp)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	log.Printf("TriggerRebalance otpNodeList: %v", otpNodeList)
+	c.logger().Infof("TriggerRebalance otpNodeList: %v", otpNodeList)
 
 	liveNodePort := c.LocalCouchbasePort // TODO: we should be getting this from etcd
 
@@ -684,9 +818,70 @@ func (c CouchbaseCluster) TriggerRebalance(liveNodeIp string) error {
 		"knownNodes":   {otpNodes},
 	}
 
-	log.Printf("TriggerRebalance encoded form value: %v", data.Encode())
+	c.logger().Infof("TriggerRebalance encoded form value: %v", data.Encode())
+
+	if err := c.POST(false, endpointUrl, data); err != nil {
+		c.RecordEvent(EVENT_REBALANCE_FAILED, "Failed to start rebalance of %v: %v", otpNodes, err)
+		return err
+	}
+
+	c.RecordEvent(EVENT_REBALANCE_STARTED, "Started rebalance of %v", otpNodes)
+	return nil
+}
+
+// Rebalance the nodes with the given ips out of the cluster, connecting to
+// liveNodeIp, which must not be one of them.  Waits for the rebalance to finish.
+func (c CouchbaseCluster) RebalanceOutNodes(liveNodeIp string, nodeIps []string) error {
+
+	c.logger().Infof("RebalanceOutNodes() called with: %v", nodeIps)
+
+	otpNodeList, err := c.OtpNodeList(liveNodeIp)
+	if err != nil {
+		return err
+	}
+
+	ejectedNodeList := []string{}
+	for _, nodeIp := range nodeIps {
+		otpNode := fmt.Sprintf("ns_1@%v", nodeIp)
+		found := false
+		for _, knownOtpNode := range otpNodeList {
+			if knownOtpNode == otpNode {
+				found = true
+			}
+		}
+		if !found {
+			c.logger().Infof("Node %v is not in the cluster, no need to rebalance it out", nodeIp)
+			continue
+		}
+		ejectedNodeList = append(ejectedNodeList, otpNode)
+	}
+
+	if len(ejectedNodeList) == 0 {
+		return nil
+	}
+
+	if err := c.WaitUntilNoRebalanceRunning(liveNodeIp); err != nil {
+		return err
+	}
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/controller/rebalance", liveNodeIp, c.LocalCouchbasePort)
+
+	data := url.Values{
+		"ejectedNodes": {strings.Join(ejectedNodeList, ",")},
+		"knownNodes":   {strings.Join(otpNodeList, ",")},
+	}
+
+	c.logger().Infof("Rebalancing out: %v", ejectedNodeList)
+
+	if err := c.POST(false, endpointUrl, data); err != nil {
+		c.RecordEvent(EVENT_REBALANCE_FAILED, "Failed to start rebalancing out %v: %v", ejectedNodeList, err)
+		return err
+	}
+
+	c.RecordEvent(EVENT_REBALANCE_STARTED, "Started rebalancing out %v", ejectedNodeList)
+
+	return c.WaitUntilRebalanceFinished(liveNodeIp)
 
-	return c.POST(false, endpointUrl, data)
 }
 
 // The rebalance command needs the current list of nodes, and it wants
@@ -709,7 +904,7 @@ func (c CouchbaseCluster) OtpNodeList(liveNodeIp string) ([]string, error) {
 
 		otpNode := nodeMap["otpNode"] // ex: "ns_1@10.231.192.180"
 		otpNodeStr, ok := otpNode.(string)
-		log.Printf("OtpNodeList, otpNode: %v", otpNodeStr)
+		c.logger().Infof("OtpNodeList, otpNode: %v", otpNodeStr)
 
 		if !ok {
 			return otpNodeList, fmt.Errorf("No otpNode string found")
@@ -725,7 +920,7 @@ func (c CouchbaseCluster) OtpNodeList(liveNodeIp string) ([]string, error) {
 
 func (c CouchbaseCluster) GetClusterNodes(liveNodeIp string) ([]interface{}, error) {
 
-	log.Printf("GetClusterNodes() called with: %v", liveNodeIp)
+	c.logger().Infof("GetClusterNodes() called with: %v", liveNodeIp)
 	liveNodePort := c.LocalCouchbasePort // TODO: we should be getting this from etcd
 
 	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default", liveNodeIp, liveNodePort)
@@ -746,18 +941,68 @@ func (c CouchbaseCluster) GetClusterNodes(liveNodeIp string) ([]interface{}, err
 
 }
 
+// A node as reported in the nodes list of /pools/default
+type PoolNode struct {
+	Hostname          string   `json:"hostname"` // ie, 10.153.167.148:8091
+	OtpNode           string   `json:"otpNode"`  // ie, ns_1@10.153.167.148
+	Status            string   `json:"status"`
+	ClusterMembership string   `json:"clusterMembership"`
+	Version           string   `json:"version"`
+	Services          []string `json:"services,omitempty"` // only reported by 4.0 and up
+	MemoryTotal       int64    `json:"memoryTotal"`
+	MemoryFree        int64    `json:"memoryFree"`
+	ThisNode          bool     `json:"thisNode,omitempty"` // the node that answered the request
+}
+
+// Same as GetClusterNodes, but decoded into PoolNodes
+func (c CouchbaseCluster) GetPoolNodes(liveNodeIp string) ([]PoolNode, error) {
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default", liveNodeIp, c.LocalCouchbasePort)
+
+	pool := struct {
+		Nodes []PoolNode `json:"nodes"`
+	}{}
+	if err := c.getJsonData(endpointUrl, &pool); err != nil {
+		return nil, err
+	}
+
+	return pool.Nodes, nil
+
+}
+
+// Get the names of all buckets in the cluster
+func (c CouchbaseCluster) GetBucketNames(liveNodeIp string) ([]string, error) {
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default/buckets", liveNodeIp, c.LocalCouchbasePort)
+
+	buckets := []struct {
+		Name string `json:"name"`
+	}{}
+	if err := c.getJsonData(endpointUrl, &buckets); err != nil {
+		return nil, err
+	}
+
+	bucketNames := []string{}
+	for _, bucket := range buckets {
+		bucketNames = append(bucketNames, bucket.Name)
+	}
+
+	return bucketNames, nil
+
+}
+
 // Since AddNode seems to fail sometimes (I saw a case where it returned a 400 error)
 // retry several times before finally giving up.
 func (c CouchbaseCluster) AddNodeRetry(liveNodeIp string) error {
 
 	numSecondsToSleep := 0
 
-	for i := 0; i < MAX_RETRIES_JOIN_CLUSTER; i++ {
+	for i := 0; i < activeConfig.MaxRetriesJoinCluster; i++ {
 
 		numSecondsToSleep += 10
 
 		if err := c.AddNode(liveNodeIp); err != nil {
-			log.Printf("AddNode failed with err: %v.  Will retry in %v secs", err, numSecondsToSleep)
+			c.logger().Warnf("AddNode failed with err: %v.  Will retry in %v secs", err, numSecondsToSleep)
 
 		} else {
 			// it worked, we are done
@@ -777,7 +1022,7 @@ func (c CouchbaseCluster) AddNodeRetry(liveNodeIp string) error {
 
 func (c CouchbaseCluster) AddNode(liveNodeIp string) error {
 
-	log.Printf("AddNode()")
+	c.logger().Infof("AddNode()")
 
 	liveNodePort := c.LocalCouchbasePort // TODO: we should be getting this from etcd
 
@@ -789,13 +1034,13 @@ func (c CouchbaseCluster) AddNode(liveNodeIp string) error {
 		"password": {c.AdminPassword},
 	}
 
-	log.Printf("AddNode posting to %v with data: %v", endpointUrl, data.Encode())
+	c.logger().With("endpoint", endpointUrl).Infof("AddNode adding %v as user %v", c.LocalCouchbaseIp, c.AdminUsername)
 
 	err := c.POST(false, endpointUrl, data)
 	if err != nil {
 		if strings.Contains(err.Error(), "Node is already part of cluster") {
 			// absorb the error in this case, since its harmless
-			log.Printf("Node was already part of cluster, so no need to add")
+			c.logger().Infof("Node was already part of cluster, so no need to add")
 		} else {
 			return err
 		}
@@ -807,11 +1052,11 @@ func (c CouchbaseCluster) AddNode(liveNodeIp string) error {
 
 func (c CouchbaseCluster) WaitUntilNoRebalanceRunning(liveNodeIp string) error {
 
-	log.Printf("WaitUntilNoRebalanceRunning()")
+	c.logger().Infof("WaitUntilNoRebalanceRunning()")
 
 	numSecondsToSleep := 0
 
-	for i := 0; i < MAX_RETRIES_JOIN_CLUSTER; i++ {
+	for i := 0; i < activeConfig.MaxRetriesJoinCluster; i++ {
 
 		numSecondsToSleep += 100
 
@@ -825,14 +1070,14 @@ func (c CouchbaseCluster) WaitUntilNoRebalanceRunning(liveNodeIp string) error {
 
 			time2wait := time.Second * time.Duration(numSecondsToSleep)
 
-			log.Printf("Rebalance in progress, waiting %v seconds", time2wait)
+			c.logger().Infof("Rebalance in progress, waiting %v seconds", time2wait)
 
 			<-time.After(time2wait)
 
 			continue
 		case false:
 
-			log.Printf("No rebalance in progress")
+			c.logger().Infof("No rebalance in progress")
 
 			return nil
 		}
@@ -873,28 +1118,48 @@ func (c CouchbaseCluster) getJsonData(endpointUrl string, into interface{}) erro
 	middleware := func(req *http.Request) {
 		req.SetBasicAuth(c.AdminUsername, c.AdminPassword)
 	}
+	c.logger().With("endpoint", endpointUrl).Debugf("GET")
 	return getJsonDataMiddleware(endpointUrl, into, middleware)
 
 }
 
+func (c CouchbaseCluster) getJsonDataStatus(endpointUrl string, into interface{}) (int, error) {
+
+	middleware := func(req *http.Request) {
+		req.SetBasicAuth(c.AdminUsername, c.AdminPassword)
+	}
+	return getJsonDataStatusMiddleware(endpointUrl, into, middleware)
+
+}
+
 func (c CouchbaseCluster) POST(defaultAdminCreds bool, endpointUrl string, data url.Values) error {
 
+	_, err := c.POSTBody(defaultAdminCreds, endpointUrl, data)
+	return err
+
+}
+
+// Same as POST, but also returns the response body
+func (c CouchbaseCluster) POSTBody(defaultAdminCreds bool, endpointUrl string, data url.Values) ([]byte, error) {
+
+	c.logger().With("endpoint", endpointUrl).Debugf("POST")
+
 	client := &http.Client{}
 
 	req, err := http.NewRequest("POST", endpointUrl, strings.NewReader(data.Encode()))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	if defaultAdminCreds {
-		req.SetBasicAuth(COUCHBASE_DEFAULT_ADMIN_USERNAME, COUCHBASE_DEFAULT_ADMIN_PASSWORD)
+		req.SetBasicAuth(activeConfig.FactoryAdminUsername, activeConfig.FactoryAdminPassword)
 	} else {
 		req.SetBasicAuth(c.AdminUsername, c.AdminPassword)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -907,7 +1172,7 @@ func (c CouchbaseCluster) POST(defaultAdminCreds bool, endpointUrl string, data
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"Failed to POST to %v.  Status code: %v.  Body: %v",
 			endpointUrl,
 			resp.StatusCode,
@@ -915,56 +1180,157 @@ func (c CouchbaseCluster) POST(defaultAdminCreds bool, endpointUrl string, data
 		)
 	}
 
+	return bodyBytes, nil
+
+}
+
+func (c CouchbaseCluster) DELETE(endpointUrl string) error {
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("DELETE", endpointUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.AdminUsername, c.AdminPassword)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf(
+			"Failed to DELETE %v.  Status code: %v.  Body: %v",
+			endpointUrl,
+			resp.StatusCode,
+			string(bodyBytes),
+		)
+	}
+
 	return nil
 
 }
 
 // An an vent loop that:
-//   - publishes the fact that we are alive into etcd.
-func (c CouchbaseCluster) EventLoop() {
+//   - publishes the fact that we are alive into etcd, while couchbase is running.
+//
+// Only returns if couchbase exits and the service manager reports it.
+func (c CouchbaseCluster) EventLoop() error {
 
-	log.Printf("EventLoop()")
+	c.logger().Infof("EventLoop()")
 
 	var lastErr error
 
+	// the otpNodes of the failed over nodes that have been recorded
+	failedOver := map[string]bool{}
+
 	for {
 
+		// a node that is down must not look joinable to other nodes, so
+		// let its node state expire until couchbase is back
+		running, err := c.ServiceManager.Running()
+		if err != nil || !running {
+			c.logger().Warnf("Couchbase is not running (err: %v), not publishing node state", err)
+			select {
+			case exitErr := <-c.ServiceManager.Exited():
+				return exitErr
+			case <-time.After(time.Second * 5):
+			}
+			continue
+		}
+
 		// update the node-state directory ttl.  we want this directory
 		// to disappear in case all nodes in the cluster are down, since
 		// otherwise it would just be unwanted residue.
 		ttlSeconds := uint64(10)
-		_, err := c.etcdClient.UpdateDir(KEY_NODE_STATE, ttlSeconds)
+		_, err = c.etcdClient.UpdateDir(KEY_NODE_STATE, ttlSeconds)
 		if err != nil {
 			msg := fmt.Sprintf("Error updating %v dir in etc with new TTL. "+
 				"Ignoring error, but this could cause problems",
 				KEY_NODE_STATE)
-			log.Printf(msg)
+			c.logger().Warnf("%v", msg)
 		}
 
 		// publish our ip into etcd with short ttl
-		if err := c.PublishNodeStateEtcd(ttlSeconds); err != nil {
+		publishStart := time.Now()
+		err = c.PublishNodeStateEtcd(ttlSeconds)
+		c.metrics.recordEtcdLatency(time.Since(publishStart))
+		c.metrics.recordHeartbeat(err)
+		if err != nil {
 			msg := fmt.Sprintf("Error publishing node state to etcd: %v. "+
 				"Ignoring error, but other nodes won't be able to join"+
 				"this node until this issue is resolved.",
 				err)
-			log.Printf(msg)
+			c.logger().Warnf("%v", msg)
 			lastErr = err
 		} else {
-			log.Printf("Published node state to etcd")
+			c.logger().Infof("Published node state to etcd")
 			// if we had an error earlier, but it's now resolved,
 			// lets log that fact
 			if lastErr != nil {
 				msg := fmt.Sprintf("Successfully node state to etcd: %v. "+
 					"The previous error seems to have fixed itself!",
 					err)
-				log.Printf(msg)
+				c.logger().Infof("%v", msg)
 				lastErr = nil
 			}
 		}
 
+		// pick up credentials changed by rotate-credentials
+		changed, err := c.ReloadAdminCredsEtcd()
+		if err != nil {
+			c.logger().Warnf("Error reloading admin credentials from etcd: %v", err)
+		} else if changed {
+			c.logger().Infof("Admin credentials changed, now using the new ones")
+			c.RecordEvent(EVENT_CREDENTIALS_CHANGED, "Reloaded rotated admin credentials of user %v", c.AdminUsername)
+		}
+
+		c.recordFailovers(failedOver)
+
 		// sleep for a while
-		<-time.After(time.Second * time.Duration(ttlSeconds/2))
+		select {
+		case exitErr := <-c.ServiceManager.Exited():
+			return exitErr
+		case <-time.After(time.Second * time.Duration(ttlSeconds/2)):
+		}
+
+	}
+
+}
+
+// Record a failover event for each node that our couchbase reports as
+// failed over and that is not in failedOver yet.  Nodes that are no longer
+// failed over, ie because they were added back, are removed from
+// failedOver so a later failover of them is recorded again.
+func (c CouchbaseCluster) recordFailovers(failedOver map[string]bool) {
+
+	poolNodes, err := c.GetPoolNodes(c.LocalCouchbaseIp)
+	if err != nil {
+		c.logger().Warnf("Error getting nodes to check for failovers: %v", err)
+		return
+	}
+
+	stillFailedOver := map[string]bool{}
+	for _, poolNode := range poolNodes {
+		if poolNode.ClusterMembership != "inactiveFailed" {
+			continue
+		}
+		stillFailedOver[poolNode.OtpNode] = true
+		if failedOver[poolNode.OtpNode] {
+			continue
+		}
+		c.logger().Warnf("Node %v has been failed over", poolNode.OtpNode)
+		c.RecordEvent(EVENT_FAILOVER, "Node %v has been failed over (status: %v)", poolNode.OtpNode, poolNode.Status)
+		failedOver[poolNode.OtpNode] = true
+	}
 
+	for otpNode := range failedOver {
+		if !stillFailedOver[otpNode] {
+			delete(failedOver, otpNode)
+		}
 	}
 
 }
@@ -976,7 +1342,7 @@ func (c CouchbaseCluster) PublishNodeStateEtcd(ttlSeconds uint64) error {
 	// TODO: maybe this should be ip:port
 	key := path.Join(KEY_NODE_STATE, c.LocalCouchbaseIp)
 
-	log.Printf("Publish node-state to key: %v", key)
+	c.logger().Infof("Publish node-state to key: %v", key)
 
 	_, err := c.etcdClient.Set(key, "up", ttlSeconds)
 
@@ -1018,84 +1384,20 @@ func RetryLoop(worker RetryWorker, sleeper RetrySleeper) error {
 	}
 }
 
-// Connect to etcd and grap the first node that is up
-// Connect to Couchbase Cluster via REST api and get node states
-// If all nodes are healthy, then return.  Otherwise retry loop.
-func (c CouchbaseCluster) WaitUntilClusterRunning(maxAttempts int) error {
-
-	worker := func() (bool, error) {
-		liveNodeIp, err := c.FindLiveNode()
-		if err != nil || liveNodeIp == "" {
-			log.Printf("FindLiveNode returned err: %v or empty ip", err)
-			return false, nil
-		}
-		log.Printf("Connecting to liveNodeIp: %v", liveNodeIp)
-
-		ok, err := c.CheckAllNodesClusterHealthy(liveNodeIp)
-		if err != nil || !ok {
-			log.Printf("CheckAllNodesClusterHealthy checked failed.  ok: %v err: %v", ok, err)
-			return false, nil
-		}
-		return true, nil
-
-	}
-
-	sleeper := func(numAttempts int) (bool, int) {
-		if numAttempts > maxAttempts {
-			return false, -1
-		}
-		sleepSeconds := 10 * numAttempts
-		return true, sleepSeconds
-	}
-
-	return RetryLoop(worker, sleeper)
-
-}
-
-func (c CouchbaseCluster) WaitUntilNumNodesRunning(numNodes, maxAttempts int) error {
-
-	worker := func() (bool, error) {
-		liveNodeIp, err := c.FindLiveNode()
-		if err != nil || liveNodeIp == "" {
-			log.Printf("FindLiveNode returned err: %v or empty ip", err)
-			return false, nil
-		}
-		log.Printf("Connecting to liveNodeIp: %v", liveNodeIp)
-
-		ok, err := c.CheckNumNodesClusterHealthy(numNodes, liveNodeIp)
-		if err != nil || !ok {
-			log.Printf("CheckAllNodesClusterHealthy checked failed.  ok: %v err: %v", ok, err)
-			return false, nil
-		}
-		return true, nil
-
-	}
-
-	sleeper := func(numAttempts int) (bool, int) {
-		if numAttempts > maxAttempts {
-			return false, -1
-		}
-		sleepSeconds := 10 * numAttempts
-		return true, sleepSeconds
-	}
-
-	return RetryLoop(worker, sleeper)
-
-}
-
 // Find the admin credentials in etcd under /couchbase.com/userpass
-// and update this CouchbaseCluster's fields accordingly
+// and update this CouchbaseCluster's fields accordingly.  If the cluster
+// rejects them, the credentials of an unfinished rotation are tried.
 func (c *CouchbaseCluster) LoadAdminCredsFromEtcd() error {
 
 	key := path.Join(KEY_USER_PASS)
 
 	sleepSeconds := 10
 
-	for i := 0; i < MAX_RETRIES_JOIN_CLUSTER; i++ {
+	for i := 0; i < activeConfig.MaxRetriesJoinCluster; i++ {
 
 		response, err := c.etcdClient.Get(key, false, false)
 		if err != nil {
-			log.Printf("Error getting key: %v.  Err: %v.  Retrying in %v secs", key, err, sleepSeconds)
+			c.logger().Warnf("Error getting key: %v.  Err: %v.  Retrying in %v secs", key, err, sleepSeconds)
 
 			<-time.After(time.Second * time.Duration(sleepSeconds))
 
@@ -1103,16 +1405,14 @@ func (c *CouchbaseCluster) LoadAdminCredsFromEtcd() error {
 
 		}
 
-		userpassRaw := response.Node.Value
-		if !strings.Contains(userpassRaw, ":") {
-			return fmt.Errorf("Invalid user/pass: %v", userpassRaw)
+		username, password, err := DecodeCredentials(response.Node.Value)
+		if err != nil {
+			return err
 		}
+		RegisterSecret(password)
 
-		userpassComponents := strings.Split(userpassRaw, ":")
-		c.AdminUsername = userpassComponents[0]
-		c.AdminPassword = userpassComponents[1]
-
-		return nil
+		c.AdminUsername, c.AdminPassword, err = c.pendingUserPassIfRotated(username, password)
+		return err
 
 	}
 
@@ -1120,37 +1420,59 @@ func (c *CouchbaseCluster) LoadAdminCredsFromEtcd() error {
 
 }
 
-func WaitUntilCBClusterRunning(etcdServers []string) {
+// Get the admin credentials from etcd once, without retrying, and switch
+// to them if they changed since they were loaded.  Lets long running
+// daemons pick up rotated credentials, including ones of a rotation that
+// changed the cluster but not etcd yet.
+func (c *CouchbaseCluster) ReloadAdminCredsEtcd() (bool, error) {
 
-	couchbaseCluster := NewCouchbaseCluster(etcdServers)
+	response, err := c.etcdClient.Get(KEY_USER_PASS, false, false)
+	if err != nil {
+		return false, err
+	}
 
-	if err := couchbaseCluster.LoadAdminCredsFromEtcd(); err != nil {
-		log.Fatalf("Failed to get admin credentials from etc: %v", err)
+	username, password, err := DecodeCredentials(response.Node.Value)
+	if err != nil {
+		return false, err
 	}
+	RegisterSecret(password)
 
-	StupidPortHack(couchbaseCluster)
+	username, password, err = c.pendingUserPassIfRotated(username, password)
+	if err != nil {
+		return false, err
+	}
 
-	numRetries := 10000
-	if err := couchbaseCluster.WaitUntilClusterRunning(numRetries); err != nil {
-		log.Fatalf("Failed to wait until cluster running: %v", err)
+	if username == c.AdminUsername && password == c.AdminPassword {
+		return false, nil
 	}
 
+	c.AdminUsername = username
+	c.AdminPassword = password
+	return true, nil
+
 }
 
-func WaitUntilNumNodesRunning(numNodes int, etcdServers []string) {
+// Connect to etcd, load the admin credentials and find a live node to
+// talk to.  Returns the cluster along with the ip of the live node.
+func ConnectToLiveNode(etcdServers []string) (*CouchbaseCluster, string, error) {
 
 	couchbaseCluster := NewCouchbaseCluster(etcdServers)
 
 	if err := couchbaseCluster.LoadAdminCredsFromEtcd(); err != nil {
-		log.Fatalf("Failed to get admin credentials from etc: %v", err)
+		return nil, "", err
 	}
 
 	StupidPortHack(couchbaseCluster)
 
-	numRetries := 10000
-	if err := couchbaseCluster.WaitUntilNumNodesRunning(numNodes, numRetries); err != nil {
-		log.Fatalf("Failed to wait until cluster running: %v", err)
+	liveNodeIp, err := couchbaseCluster.FindLiveNode()
+	if err != nil {
+		return nil, "", err
 	}
+	if liveNodeIp == "" {
+		return nil, "", fmt.Errorf("No live node found in etcd")
+	}
+
+	return couchbaseCluster, liveNodeIp, nil
 
 }
 
@@ -1161,6 +1483,6 @@ func StupidPortHack(cluster *CouchbaseCluster) {
 	//   /couchbase.com/couchbase-node-state/10.153.167.148
 	// but we should have:
 	//   /couchbase.com/couchbase-node-state/10.153.167.148:8091
-	cluster.LocalCouchbasePort = "8091"
+	cluster.LocalCouchbasePort = activeConfig.CouchbasePort
 
 }
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"os"
 
 	"github.com/docopt/docopt-go"
 	"github.com/tleyden/couchbase-cluster-go"
@@ -12,48 +13,347 @@ func main() {
 	usage := `Couchbase-Cluster.
 
 Usage:
-  couchbase-cluster wait-until-running [--etcd-servers=<server-list>] 
-  couchbase-cluster start-couchbase-node --local-ip=<ip>
+  couchbase-cluster wait-until-running [--timeout=<duration>] [--num-nodes=<n>] [--bucket=<bucket>] [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster start-couchbase-node --local-ip=<ip> [--views-dir=<dir>] [--backup-dir=<dir> --backup-interval=<duration>] [--backup-keep=<n>] [--seed-data=<path>] [--seed-bucket=<bucket>] [--seed-bucket-password=<pass>] [--metrics-addr=<addr>] [--health-addr=<addr>] [--service-manager=<name>] [--config=<file>]
+  couchbase-cluster views apply [--dir=<dir>] [--bucket=<bucket>] [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster replicas set --replicas=<n> [--bucket=<bucket>] [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster replicas apply [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster xdcr apply [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster xdcr status [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster backup --backup-dir=<dir> [--backup-keep=<n>] [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster restore --backup-dir=<dir> [--backup-set=<set>] [--bucket=<bucket>] [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster status [--json] [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster rotate-credentials --new-userpass=<user:pass> [--etcd-servers=<server-list>] [--config=<file>]
+  couchbase-cluster events [--follow] [--json] [--etcd-servers=<server-list>] [--config=<file>]
   couchbase-cluster -h | --help
 
 Options:
   -h --help     Show this screen.
-  --etcd-servers=<server-list>  Comma separated list of etcd servers, or omit to connect to etcd running on localhost`
+  --config=<file>  JSON or YAML config file.  Settings are taken from the built-in defaults, then this file, then CBCLUSTER_* environment variables (ie CBCLUSTER_COUCHBASE_PORT), then flags.  Set creds_key_file (CBCLUSTER_CREDS_KEY_FILE) to encrypt the credentials stored in etcd, and log_level (debug, info, warn, error) and log_format (text, json) to control logging
+  --etcd-servers=<server-list>  Comma separated list of etcd servers, or omit to connect to etcd running on localhost
+  --views-dir=<dir>  Directory of design docs (<name>.json) to apply to the default bucket when initializing the cluster, or omit to use design docs stored in etcd
+  --dir=<dir>  Directory of design docs (<name>.json), or omit to use design docs stored in etcd
+  --bucket=<bucket>  The bucket to apply the design docs, replica number or restore to, or to wait for.  Defaults to the default bucket, except for wait-until-running which then does not wait for a bucket
+  --timeout=<duration>  How long to wait, ie: 10m, or omit to wait forever.  wait-until-running exits with 2 on timeout, 3 if the admin credentials are rejected and 4 if etcd is unreachable, which it also does without a timeout after etcd failed to answer 30 polls in a row
+  --num-nodes=<n>  The number of nodes to wait for, or omit to wait for all the nodes in the cluster
+  --replicas=<n>  The number of replicas the bucket should have, which needs at least n+1 healthy nodes
+  --backup-dir=<dir>  Directory to write timestamped backup sets into, or to restore them from
+  --backup-interval=<duration>  How often to back up the cluster from the node daemon, ie: 24h.  Only one node does each backup
+  --backup-keep=<n>  Number of most recent backup sets to keep [default: 7]
+  --backup-set=<set>  The backup set (ie, 20150102T150405Z) to restore, or omit to restore the latest
+  --seed-data=<path>  Directory of <key>.json docs, or a JSON-lines file of docs with an _id field, loaded once when initializing the cluster
+  --seed-bucket=<bucket>  The bucket to load the seed data into [default: default]
+  --seed-bucket-password=<pass>  The SASL password of the seed bucket, if it has one [default: ]
+  --metrics-addr=<addr>  Serve prometheus metrics of the node daemon on this address, ie :9091
+  --health-addr=<addr>  Serve /healthz and /readyz of the node daemon on this address, which may be the same as --metrics-addr
+  --service-manager=<name>  How to start couchbase: sysvinit, systemd, exec (run couchbase-server as a child of the node daemon, ie in a container.  The daemon exits when it does, so that fleet restarts the unit) or auto to detect it.  Overrides service_manager in the config
+  --json  Print the status or events as json
+  --follow  Keep printing new events as they are recorded
+  --new-userpass=<user:pass>  The new admin username and password, delimited by the first colon (:)`
 
 	arguments, _ := docopt.Parse(usage, nil, true, "Couchbase-Cluster", false)
+	cbcluster.RegisterSecretArgs(arguments)
+	if err := cbcluster.LoadConfigFromDocOpt(arguments); err != nil {
+		fatalf("Invalid config: %v", err)
+	}
 	etcdServers := cbcluster.ExtractEtcdServerList(arguments)
 
 	if cbcluster.IsCommandEnabled(arguments, "wait-until-running") {
-		cbcluster.WaitUntilCBClusterRunning(etcdServers)
-		return
+		os.Exit(waitUntilRunning(etcdServers, arguments))
 	}
 
 	if cbcluster.IsCommandEnabled(arguments, "start-couchbase-node") {
 
-		localIp, found := arguments["--local-ip"]
-		if !found {
-			log.Fatalf("Required argument missing")
+		startCouchbaseNode(etcdServers, arguments)
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "status") {
+		if err := status(etcdServers, arguments); err != nil {
+			fatalf("Failed to get cluster status: %v", err)
+		}
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "events") {
+		if err := events(etcdServers, arguments); err != nil {
+			fatalf("Failed to get events: %v", err)
+		}
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "rotate-credentials") {
+		newUserPass, err := cbcluster.ExtractStringArg(arguments, "--new-userpass")
+		if err != nil {
+			fatalf("Invalid new userpass: %v", err)
+		}
+		if err := cbcluster.RotateCredentials(etcdServers, newUserPass); err != nil {
+			fatalf("Failed to rotate credentials: %v", err)
+		}
+		cbcluster.DefaultLogger().Infof("Credentials rotated")
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "backup") {
+		backup(etcdServers, arguments)
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "restore") {
+		restore(etcdServers, arguments)
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "views") && cbcluster.IsCommandEnabled(arguments, "apply") {
+		applyViews(etcdServers, arguments)
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "xdcr") {
+		if err := xdcr(etcdServers, arguments); err != nil {
+			fatalf("XDCR failed: %v", err)
+		}
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "replicas") {
+		if err := changeReplicas(etcdServers, arguments); err != nil {
+			fatalf("Failed to change replicas: %v", err)
 		}
-		localIpString := localIp.(string)
-		startCouchbaseNode(etcdServers, localIpString)
 		return
 	}
 
 }
 
-func startCouchbaseNode(etcdServers []string, localIp string) {
+// Exit codes of wait-until-running
+const (
+	EXIT_FAILED           = 1
+	EXIT_TIMEOUT          = 2
+	EXIT_AUTH_FAILED      = 3
+	EXIT_ETCD_UNREACHABLE = 4
+)
+
+func waitUntilRunning(etcdServers []string, arguments map[string]interface{}) int {
+
+	options := cbcluster.WaitOptions{}
+	options.Bucket, _ = cbcluster.ExtractStringArg(arguments, "--bucket")
+
+	if _, err := cbcluster.ExtractStringArg(arguments, "--timeout"); err == nil {
+		options.Timeout, err = cbcluster.ExtractDurationArg(arguments, "--timeout")
+		if err != nil {
+			cbcluster.DefaultLogger().Errorf("Invalid timeout: %v", err)
+			return EXIT_FAILED
+		}
+	}
+
+	if _, err := cbcluster.ExtractStringArg(arguments, "--num-nodes"); err == nil {
+		options.NumNodes, err = cbcluster.ExtractNumNodes(arguments)
+		if err != nil || options.NumNodes < 1 {
+			cbcluster.DefaultLogger().Errorf("Invalid number of nodes: %v", arguments["--num-nodes"])
+			return EXIT_FAILED
+		}
+	}
+
+	err := cbcluster.WaitUntilRunning(etcdServers, options)
+	if err == nil {
+		cbcluster.DefaultLogger().Infof("Cluster is running")
+		return 0
+	}
+
+	cbcluster.DefaultLogger().Errorf("Failed to wait until cluster running: %v", err)
+
+	waitErr, ok := err.(cbcluster.WaitError)
+	if !ok {
+		return EXIT_FAILED
+	}
+	switch waitErr.Reason {
+	case cbcluster.WAIT_TIMEOUT:
+		return EXIT_TIMEOUT
+	case cbcluster.WAIT_AUTH_FAILED:
+		return EXIT_AUTH_FAILED
+	case cbcluster.WAIT_ETCD_UNREACHABLE:
+		return EXIT_ETCD_UNREACHABLE
+	default:
+		return EXIT_FAILED
+	}
+
+}
+
+func startCouchbaseNode(etcdServers []string, arguments map[string]interface{}) {
+
+	localIp, err := cbcluster.ExtractStringArg(arguments, "--local-ip")
+	if err != nil {
+		fatalf("Required argument missing")
+	}
 
 	couchbaseCluster := cbcluster.NewCouchbaseCluster(etcdServers)
 	couchbaseCluster.LocalCouchbaseIp = localIp
+	couchbaseCluster.DesignDocDir, _ = cbcluster.ExtractStringArg(arguments, "--views-dir")
+	couchbaseCluster.SeedDataPath, _ = cbcluster.ExtractStringArg(arguments, "--seed-data")
+	couchbaseCluster.SeedBucket, _ = cbcluster.ExtractStringArg(arguments, "--seed-bucket")
+	couchbaseCluster.SeedBucketPassword, _ = cbcluster.ExtractStringArg(arguments, "--seed-bucket-password")
+	couchbaseCluster.MetricsAddr, _ = cbcluster.ExtractStringArg(arguments, "--metrics-addr")
+	couchbaseCluster.HealthAddr, _ = cbcluster.ExtractStringArg(arguments, "--health-addr")
+
+	if serviceManagerName, err := cbcluster.ExtractStringArg(arguments, "--service-manager"); err == nil {
+		couchbaseCluster.ServiceManager, err = cbcluster.NewServiceManager(serviceManagerName)
+		if err != nil {
+			fatalf("Invalid service manager: %v", err)
+		}
+	}
+
+	if backupDir, err := cbcluster.ExtractStringArg(arguments, "--backup-dir"); err == nil {
+		couchbaseCluster.BackupDir = backupDir
+		couchbaseCluster.BackupInterval, err = cbcluster.ExtractDurationArg(arguments, "--backup-interval")
+		if err != nil {
+			fatalf("Invalid backup interval: %v", err)
+		}
+		couchbaseCluster.BackupKeep, err = cbcluster.ExtractIntArg(arguments, "--backup-keep")
+		if err != nil {
+			fatalf("Invalid backup keep: %v", err)
+		}
+	}
 
 	if err := couchbaseCluster.LoadAdminCredsFromEtcd(); err != nil {
-		log.Fatalf("Failed to get admin credentials from etc: %v", err)
+		fatalf("Failed to get admin credentials from etc: %v", err)
 	}
 
 	cbcluster.StupidPortHack(couchbaseCluster)
 
 	if err := couchbaseCluster.StartCouchbaseNode(); err != nil {
-		log.Fatal(err)
+		fatalf("%v", err)
+	}
+
+}
+
+func applyViews(etcdServers []string, arguments map[string]interface{}) {
+
+	dir, _ := cbcluster.ExtractStringArg(arguments, "--dir")
+	bucket := cbcluster.ExtractBucketOrDefault(arguments)
+
+	changed, err := cbcluster.ApplyDesignDocsToCluster(etcdServers, dir, bucket)
+	if err != nil {
+		fatalf("Failed to apply design docs: %v", err)
+	}
+
+	if len(changed) == 0 {
+		cbcluster.DefaultLogger().Infof("All design docs are up to date")
+		return
+	}
+	for _, name := range changed {
+		cbcluster.DefaultLogger().Infof("Created or updated design doc: %v", name)
+	}
+
+}
+
+func changeReplicas(etcdServers []string, arguments map[string]interface{}) error {
+
+	if cbcluster.IsCommandEnabled(arguments, "apply") {
+		return cbcluster.ApplyReplicaNumbers(etcdServers)
+	}
+
+	bucket := cbcluster.ExtractBucketOrDefault(arguments)
+	replicaNumber, err := cbcluster.ExtractIntArg(arguments, "--replicas")
+	if err != nil {
+		return err
+	}
+
+	return cbcluster.SetReplicaNumber(etcdServers, bucket, replicaNumber)
+
+}
+
+func xdcr(etcdServers []string, arguments map[string]interface{}) error {
+
+	if cbcluster.IsCommandEnabled(arguments, "apply") {
+		return cbcluster.ApplyXdcr(etcdServers)
+	}
+
+	statuses, err := cbcluster.GetXdcrStatus(etcdServers)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		fmt.Printf(
+			"%v\t%v\tstatus: %v\tchanges left: %v\terrors: %v\n",
+			status.Name,
+			status.ReplicationId,
+			status.Status,
+			status.ChangesLeft,
+			len(status.Errors),
+		)
+	}
+	return nil
+
+}
+
+func status(etcdServers []string, arguments map[string]interface{}) error {
+
+	clusterStatus, err := cbcluster.GetClusterStatus(etcdServers)
+	if err != nil {
+		return err
 	}
 
+	format := cbcluster.OUTPUT_FORMAT_TEXT
+	if cbcluster.ExtractBoolArg(arguments, "--json") {
+		format = cbcluster.OUTPUT_FORMAT_JSON
+	}
+
+	return clusterStatus.Write(os.Stdout, format)
+
+}
+
+func events(etcdServers []string, arguments map[string]interface{}) error {
+
+	format := cbcluster.OUTPUT_FORMAT_TEXT
+	if cbcluster.ExtractBoolArg(arguments, "--json") {
+		format = cbcluster.OUTPUT_FORMAT_JSON
+	}
+
+	follow := cbcluster.ExtractBoolArg(arguments, "--follow")
+
+	return cbcluster.WriteEvents(etcdServers, os.Stdout, format, follow)
+
+}
+
+func backup(etcdServers []string, arguments map[string]interface{}) {
+
+	dir, err := cbcluster.ExtractStringArg(arguments, "--backup-dir")
+	if err != nil {
+		fatalf("Invalid backup dir: %v", err)
+	}
+	keep, err := cbcluster.ExtractIntArg(arguments, "--backup-keep")
+	if err != nil {
+		fatalf("Invalid backup keep: %v", err)
+	}
+
+	setDir, err := cbcluster.RunBackup(etcdServers, dir, keep)
+	if err != nil {
+		fatalf("Backup failed: %v", err)
+	}
+
+	cbcluster.DefaultLogger().Infof("Backup written to: %v", setDir)
+
+}
+
+func restore(etcdServers []string, arguments map[string]interface{}) {
+
+	dir, err := cbcluster.ExtractStringArg(arguments, "--backup-dir")
+	if err != nil {
+		fatalf("Invalid backup dir: %v", err)
+	}
+	backupSet, _ := cbcluster.ExtractStringArg(arguments, "--backup-set")
+	bucket := cbcluster.ExtractBucketOrDefault(arguments)
+
+	if err := cbcluster.RunRestore(etcdServers, dir, backupSet, bucket); err != nil {
+		fatalf("Restore failed: %v", err)
+	}
+
+	cbcluster.DefaultLogger().Infof("Restore finished")
+
+}
+
+// Log the error through the configured logger, which redacts secrets, and exit
+func fatalf(format string, args ...interface{}) {
+	cbcluster.DefaultLogger().Errorf(format, args...)
+	os.Exit(1)
 }
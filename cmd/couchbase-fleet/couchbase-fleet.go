@@ -1,7 +1,10 @@
 package main
 
 import (
-	"log"
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
 
 	"github.com/docopt/docopt-go"
 	"github.com/tleyden/couchbase-cluster-go"
@@ -12,39 +15,92 @@ func main() {
 	usage := `Couchbase-Fleet.
 
 Usage:
-  couchbase-fleet launch-cbs --version=<cb-version> --num-nodes=<num_nodes> --userpass=<user:pass> [--etcd-servers=<server-list>] [--docker-tag=<dt>] [--skip-clean-slate-check]
+  couchbase-fleet launch-cbs --version=<cb-version> --num-nodes=<num_nodes> (--userpass=<user:pass> | --userpass-file=<file>) [--etcd-servers=<server-list>] [--fleet-endpoint=<endpoint>] [--docker-tag=<dt>] [--skip-clean-slate-check] [--template=<file>] [--image-repo=<repo>] [--data-volume=<path>] [--docker-run-args=<args>] [--memory-limit=<mem>] [--env=<env-list>] [--machine-metadata=<selectors>] [--output=<format>] [--output-file=<file>] [--config=<file>]
+  couchbase-fleet launch-sgw --num-nodes=<num_nodes> [--etcd-servers=<server-list>] [--fleet-endpoint=<endpoint>] [--docker-tag=<dt>] [--image-repo=<repo>] [--bucket=<bucket>] [--config-template=<file>] [--machine-metadata=<selectors>] [--config=<file>]
+  couchbase-fleet scale --num-nodes=<num_nodes> [--etcd-servers=<server-list>] [--fleet-endpoint=<endpoint>] [--config=<file>]
+  couchbase-fleet destroy [--etcd-servers=<server-list>] [--fleet-endpoint=<endpoint>] [--yes] [--config=<file>]
+  couchbase-fleet upgrade --version=<cb-version> [--etcd-servers=<server-list>] [--fleet-endpoint=<endpoint>] [--docker-tag=<dt>] [--image-repo=<repo>] [--template=<file>] [--config=<file>]
   couchbase-fleet -h | --help
 
 Options:
   -h --help     Show this screen.
+  --config=<file>  JSON or YAML config file.  Settings are taken from the built-in defaults, then this file, then CBCLUSTER_* environment variables (ie CBCLUSTER_COUCHBASE_PORT), then flags.  Set creds_key_file (CBCLUSTER_CREDS_KEY_FILE) to encrypt the credentials stored in etcd (every fleet machine needs a copy of the key file at the same path), and log_level (debug, info, warn, error) and log_format (text, json) to control logging
   --version=<cb-version> Couchbase Server version (3.0.1 or 2.2) 
-  --num-nodes=<num_nodes> number of couchbase nodes to start
-  --userpass <user:pass> the username and password as a single string, delimited by a colon (:)
+  --num-nodes=<num_nodes> number of couchbase (or sync gateway) nodes to start
+  --userpass <user:pass> the username and password as a single string, delimited by the first colon (:), so the password may contain colons
+  --userpass-file=<file>  a file whose first line is user:pass, instead of passing --userpass on the command line
   --etcd-servers=<server-list>  Comma separated list of etcd servers, or omit to connect to etcd running on localhos
+  --fleet-endpoint=<endpoint>  fleet api url (ie, http://localhost:49153/v1-alpha) or unix socket (ie, unix:///var/run/fleet.sock), otherwise default to http://localhost:49153/v1-alpha
   --docker-tag=<dt>  if present, use this docker tag for spawned containers, otherwise, default to "latest"
   --skip-clean-slate-check  if present, will skip the check that we are starting from clean state
+  --yes  if present, destroy without asking for confirmation
+  --template=<file>  a systemd unit or fleet unit json template to use instead of the default.  Can use {{ .IMAGE }}, {{ .DOCKER_RUN_OPTIONS }}, {{ .CB_VERSION }}, etc
+  --image-repo=<repo>  docker image repository to run, otherwise default to tleyden5iwx/couchbase-server-<cb-version> (or couchbase/sync-gateway for launch-sgw)
+  --data-volume=<path>  host path to mount as /opt/couchbase/var, otherwise default to /opt/couchbase/var
+  --docker-run-args=<args>  extra arguments to pass to docker run
+  --memory-limit=<mem>  memory limit for the container, eg 2g
+  --env=<env-list>  comma separated list of KEY=VALUE environment variables for the container
+  --machine-metadata=<selectors>  comma separated list of key=value fleet machine metadata, ie role=couchbase,disk=ssd.  Only machines with all of it are used
+  --output=<format>  format of the summary printed once the cluster is up, text or json [default: text]
+  --output-file=<file>  write the summary to this file instead of stdout
+  --bucket=<bucket>  the bucket sync gateway should use, otherwise default to "default"
+  --config-template=<file>  a sync gateway config json template to use instead of the default.  Can use {{ .SERVER_URL }}, {{ .BUCKET }} and {{ .SYNC_GW_PORT }}.  The default disables the GUEST user
 
 `
 
 	arguments, err := docopt.Parse(usage, nil, true, "Couchbase-Fleet", false)
-	log.Printf("args: %v.  err: %v", arguments, err)
+	cbcluster.RegisterSecretArgs(arguments)
+
+	if err := cbcluster.LoadConfigFromDocOpt(arguments); err != nil {
+		fatalf("Invalid config: %v", err)
+	}
+	cbcluster.DefaultLogger().Debugf("args: %v.  err: %v", arguments, err)
 
 	if cbcluster.IsCommandEnabled(arguments, "launch-cbs") {
 		if err := launchCouchbaseServer(arguments); err != nil {
-			log.Fatalf("Failed: %v", err)
+			fatalf("Failed: %v", err)
+		}
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "launch-sgw") {
+		if err := launchSyncGateway(arguments); err != nil {
+			fatalf("Failed: %v", err)
+		}
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "scale") {
+		if err := scaleCouchbaseServer(arguments); err != nil {
+			fatalf("Failed: %v", err)
+		}
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "upgrade") {
+		if err := upgradeCouchbaseServer(arguments); err != nil {
+			fatalf("Failed: %v", err)
+		}
+		return
+	}
+
+	if cbcluster.IsCommandEnabled(arguments, "destroy") {
+		if err := destroyCouchbaseServer(arguments); err != nil {
+			fatalf("Failed: %v", err)
 		}
 		return
 	}
 
-	log.Printf("Nothing to do!")
+	cbcluster.DefaultLogger().Infof("Nothing to do!")
 
 }
 
 func launchCouchbaseServer(arguments map[string]interface{}) error {
 
-	etcdServers := cbcluster.ExtractEtcdServerList(arguments)
-
-	couchbaseFleet := cbcluster.NewCouchbaseFleet(etcdServers)
+	couchbaseFleet, err := newCouchbaseFleet(arguments)
+	if err != nil {
+		return err
+	}
 	if err := couchbaseFleet.ExtractDocOptArgs(arguments); err != nil {
 		return err
 	}
@@ -52,3 +108,89 @@ func launchCouchbaseServer(arguments map[string]interface{}) error {
 	return couchbaseFleet.LaunchCouchbaseServer()
 
 }
+
+func launchSyncGateway(arguments map[string]interface{}) error {
+
+	couchbaseFleet, err := newCouchbaseFleet(arguments)
+	if err != nil {
+		return err
+	}
+	if err := couchbaseFleet.ExtractSyncGwDocOptArgs(arguments); err != nil {
+		return err
+	}
+
+	return couchbaseFleet.LaunchSyncGateway()
+
+}
+
+func scaleCouchbaseServer(arguments map[string]interface{}) error {
+
+	numNodes, err := cbcluster.ExtractNumNodes(arguments)
+	if err != nil {
+		return err
+	}
+
+	couchbaseFleet, err := newCouchbaseFleet(arguments)
+	if err != nil {
+		return err
+	}
+	couchbaseFleet.NumNodes = numNodes
+
+	return couchbaseFleet.Scale()
+
+}
+
+func destroyCouchbaseServer(arguments map[string]interface{}) error {
+
+	if !cbcluster.ExtractBoolArg(arguments, "--yes") {
+		fmt.Printf("This will destroy all couchbase_node and sync_gw_node units and remove the cluster state from etcd.  Continue? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			cbcluster.DefaultLogger().Infof("Not destroying cluster")
+			return nil
+		}
+	}
+
+	couchbaseFleet, err := newCouchbaseFleet(arguments)
+	if err != nil {
+		return err
+	}
+
+	return couchbaseFleet.Destroy()
+
+}
+
+func upgradeCouchbaseServer(arguments map[string]interface{}) error {
+
+	couchbaseFleet, err := newCouchbaseFleet(arguments)
+	if err != nil {
+		return err
+	}
+	if err := couchbaseFleet.ExtractUnitDocOptArgs(arguments); err != nil {
+		return err
+	}
+
+	return couchbaseFleet.Upgrade()
+
+}
+
+func newCouchbaseFleet(arguments map[string]interface{}) (*cbcluster.CouchbaseFleet, error) {
+
+	etcdServers := cbcluster.ExtractEtcdServerList(arguments)
+
+	couchbaseFleet := cbcluster.NewCouchbaseFleet(etcdServers)
+	couchbaseFleet.FleetEndpoint = cbcluster.ExtractFleetEndpointOrDefault(arguments)
+	if err := couchbaseFleet.ConnectToFleet(); err != nil {
+		return nil, err
+	}
+
+	return couchbaseFleet, nil
+
+}
+
+// Log the error through the configured logger, which redacts secrets, and exit
+func fatalf(format string, args ...interface{}) {
+	cbcluster.DefaultLogger().Errorf(format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,447 @@
+package cbcluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONFIG_ENV_PREFIX = "CBCLUSTER_"
+)
+
+// The tunables of both CLIs.  They are merged in this order, each one
+// overriding the ones before it:
+//
+//  1. the built-in defaults (the constants in cluster.go and fleet.go)
+//  2. the config file given with --config (json, or a simple subset of yaml)
+//  3. CBCLUSTER_<KEY> environment variables, ie CBCLUSTER_COUCHBASE_PORT=8091
+//  4. command line flags
+//
+// List values are comma separated in environment variables.
+type Config struct {
+	EtcdServers                []string `json:"etcd_servers"` // if empty, connect to etcd on localhost
+	FleetEndpoint              string   `json:"fleet_endpoint"`
+	CouchbasePort              string   `json:"couchbase_port"`
+	DefaultBucketRamMB         int      `json:"default_bucket_ram_mb"`
+	DefaultBucketReplicaNumber int      `json:"default_bucket_replica_number"`
+	FactoryAdminUsername       string   `json:"factory_admin_username"` // the credentials of an uninitialized couchbase node
+	FactoryAdminPassword       string   `json:"factory_admin_password"`
+	MaxRetriesJoinCluster      int      `json:"max_retries_join_cluster"`
+	MaxRetriesStartCouchbase   int      `json:"max_retries_start_couchbase"`
+	ImageRepoPrefix            string   `json:"image_repo_prefix"` // the couchbase version is appended, ie: -3.0.1
+	DataVolume                 string   `json:"data_volume"`
+	CredsKeyFile               string   `json:"creds_key_file"`         // if set, the credentials in etcd are encrypted with this key
+	LogLevel                   string   `json:"log_level"`              // debug, info, warn or error
+	LogFormat                  string   `json:"log_format"`             // text or json
+	EventTtlSeconds            int      `json:"event_ttl_seconds"`      // how long events stay in the journal, 0 to keep them forever
+	ServiceManager             string   `json:"service_manager"`        // how to start couchbase: auto, sysvinit, systemd or exec
+	CouchbaseExecCommand       string   `json:"couchbase_exec_command"` // the command line the exec service manager runs
+}
+
+// The config in effect, used by NewCouchbaseCluster, NewCouchbaseFleet and
+// everything they do.  Change it with SetConfig.
+var activeConfig = DefaultConfig()
+
+func DefaultConfig() Config {
+
+	defaultBucketRamMB, _ := strconv.Atoi(DEFAULT_BUCKET_RAM_MB)
+	defaultBucketReplicaNumber, _ := strconv.Atoi(DEFAULT_BUCKET_REPLICA_NUMBER)
+
+	return Config{
+		EtcdServers:                []string{},
+		FleetEndpoint:              FLEET_API_ENDPOINT,
+		CouchbasePort:              LOCAL_COUCHBASE_PORT,
+		DefaultBucketRamMB:         defaultBucketRamMB,
+		DefaultBucketReplicaNumber: defaultBucketReplicaNumber,
+		FactoryAdminUsername:       COUCHBASE_DEFAULT_ADMIN_USERNAME,
+		FactoryAdminPassword:       COUCHBASE_DEFAULT_ADMIN_PASSWORD,
+		MaxRetriesJoinCluster:      MAX_RETRIES_JOIN_CLUSTER,
+		MaxRetriesStartCouchbase:   MAX_RETRIES_START_COUCHBASE,
+		ImageRepoPrefix:            DEFAULT_IMAGE_REPO_PREFIX,
+		DataVolume:                 DEFAULT_DATA_VOLUME,
+		LogLevel:                   LOG_LEVEL_INFO,
+		LogFormat:                  LOG_FORMAT_TEXT,
+		EventTtlSeconds:            DEFAULT_EVENT_TTL_SECONDS,
+		ServiceManager:             SERVICE_MANAGER_AUTO,
+		CouchbaseExecCommand:       DEFAULT_COUCHBASE_EXEC_COMMAND,
+	}
+
+}
+
+// Validate the config and make it the one in effect.  This also replaces
+// the default logger with one using the configured level and format.
+func SetConfig(config Config) error {
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	activeConfig = config
+	SetDefaultLogger(NewStreamLogger(os.Stderr, config.LogLevel, config.LogFormat))
+	return nil
+
+}
+
+func CurrentConfig() Config {
+	return activeConfig
+}
+
+// Start from the defaults, then apply the config file at configPath (if
+// not empty) and then the CBCLUSTER_* variables in environ, which is in the
+// form returned by os.Environ().
+func LoadConfig(configPath string, environ []string) (Config, error) {
+
+	config := DefaultConfig()
+
+	if configPath != "" {
+		if err := config.applyFile(configPath); err != nil {
+			return Config{}, fmt.Errorf("Invalid config file %v: %v", configPath, err)
+		}
+	}
+
+	if err := config.applyEnv(environ); err != nil {
+		return Config{}, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+
+}
+
+func (config Config) Validate() error {
+
+	for _, etcdServer := range config.EtcdServers {
+		etcdUrl, err := url.Parse(etcdServer)
+		if err != nil || etcdUrl.Host == "" {
+			return fmt.Errorf("Invalid etcd server: %v.  Expected a url, ie http://127.0.0.1:4001", etcdServer)
+		}
+	}
+
+	fleetUrl, err := url.Parse(config.FleetEndpoint)
+	if err != nil {
+		return fmt.Errorf("Invalid fleet endpoint: %v", err)
+	}
+	switch fleetUrl.Scheme {
+	case "http", "https", "unix":
+	default:
+		return fmt.Errorf("Invalid fleet endpoint: %v.  Expected an http(s) or unix:// url", config.FleetEndpoint)
+	}
+
+	port, err := strconv.Atoi(config.CouchbasePort)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("Invalid couchbase port: %v", config.CouchbasePort)
+	}
+
+	// couchbase refuses buckets smaller than this
+	if config.DefaultBucketRamMB < 100 {
+		return fmt.Errorf("Default bucket ram must be at least 100 MB, got %v", config.DefaultBucketRamMB)
+	}
+
+	if config.DefaultBucketReplicaNumber < 0 || config.DefaultBucketReplicaNumber > MAX_REPLICA_NUMBER {
+		return fmt.Errorf(
+			"Default bucket replica number must be between 0 and %v, got %v",
+			MAX_REPLICA_NUMBER,
+			config.DefaultBucketReplicaNumber,
+		)
+	}
+
+	if config.FactoryAdminUsername == "" || config.FactoryAdminPassword == "" {
+		return fmt.Errorf("Factory admin username and password must not be empty")
+	}
+
+	if config.MaxRetriesJoinCluster < 1 || config.MaxRetriesStartCouchbase < 1 {
+		return fmt.Errorf("Max retries must be at least 1")
+	}
+
+	if config.ImageRepoPrefix == "" {
+		return fmt.Errorf("Image repo prefix must not be empty")
+	}
+
+	if config.CredsKeyFile != "" {
+		if _, err := os.Stat(config.CredsKeyFile); err != nil {
+			return fmt.Errorf("Invalid creds key file: %v", err)
+		}
+	}
+
+	if !isLogLevel(config.LogLevel) {
+		return fmt.Errorf("Invalid log level: %v.  Expected one of: %v", config.LogLevel, strings.Join(LOG_LEVELS, ", "))
+	}
+
+	if config.LogFormat != LOG_FORMAT_TEXT && config.LogFormat != LOG_FORMAT_JSON {
+		return fmt.Errorf("Invalid log format: %v.  Expected text or json", config.LogFormat)
+	}
+
+	if config.EventTtlSeconds < 0 {
+		return fmt.Errorf("Event ttl seconds must not be negative, got %v", config.EventTtlSeconds)
+	}
+
+	if !isServiceManagerName(config.ServiceManager) {
+		return fmt.Errorf("Invalid service manager: %v.  Expected one of: %v", config.ServiceManager, strings.Join(SERVICE_MANAGERS, ", "))
+	}
+
+	if config.ServiceManager == SERVICE_MANAGER_EXEC && strings.TrimSpace(config.CouchbaseExecCommand) == "" {
+		return fmt.Errorf("Couchbase exec command must not be empty with the exec service manager")
+	}
+
+	if !filepath.IsAbs(config.DataVolume) {
+		return fmt.Errorf("Data volume must be an absolute path, got %v", config.DataVolume)
+	}
+
+	return nil
+
+}
+
+// Apply a json config file, or a yaml one if it ends in .yaml or .yml
+func (config *Config) applyFile(configPath string) error {
+
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		values, lists, err := parseSimpleYaml(contents)
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			if err := config.setString(key, value); err != nil {
+				return err
+			}
+		}
+		for key, items := range lists {
+			if err := config.set(key, items); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		// catch typos, which json.Unmarshal would silently ignore
+		rawValues := map[string]json.RawMessage{}
+		if err := json.Unmarshal(contents, &rawValues); err != nil {
+			return err
+		}
+		for key := range rawValues {
+			if !isConfigKey(key) {
+				return fmt.Errorf("Unknown config key: %v", key)
+			}
+		}
+		return json.Unmarshal(contents, config)
+	}
+
+}
+
+// Apply the CBCLUSTER_* environment variables
+func (config *Config) applyEnv(environ []string) error {
+
+	for _, keyValue := range environ {
+
+		if !strings.HasPrefix(keyValue, CONFIG_ENV_PREFIX) {
+			continue
+		}
+
+		keyValueComponents := strings.SplitN(keyValue, "=", 2)
+		if len(keyValueComponents) != 2 {
+			continue
+		}
+		envName, value := keyValueComponents[0], keyValueComponents[1]
+
+		key := strings.ToLower(strings.TrimPrefix(envName, CONFIG_ENV_PREFIX))
+		if !isConfigKey(key) {
+			// other tools may share the prefix, so only known keys are used
+			continue
+		}
+
+		if err := config.setString(key, value); err != nil {
+			return fmt.Errorf("Invalid %v: %v", envName, err)
+		}
+
+	}
+
+	return nil
+
+}
+
+func isConfigKey(key string) bool {
+
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		if configType.Field(i).Tag.Get("json") == key {
+			return true
+		}
+	}
+	return false
+
+}
+
+// Set the field whose json key is key from a single string.  List values
+// are comma separated.
+func (config *Config) setString(key, value string) error {
+
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.Tag.Get("json") == key && field.Type.Kind() == reflect.Slice {
+			return config.set(key, strings.Split(value, ","))
+		}
+	}
+	return config.set(key, []string{value})
+
+}
+
+// Set the field whose json key is key.  Single valued fields expect
+// exactly one value.
+func (config *Config) set(key string, values []string) error {
+
+	configValue := reflect.ValueOf(config).Elem()
+	configType := configValue.Type()
+
+	for i := 0; i < configType.NumField(); i++ {
+
+		if configType.Field(i).Tag.Get("json") != key {
+			continue
+		}
+
+		field := configValue.Field(i)
+
+		if field.Kind() == reflect.Slice {
+			trimmed := []string{}
+			for _, value := range values {
+				if value = strings.TrimSpace(value); value != "" {
+					trimmed = append(trimmed, value)
+				}
+			}
+			field.Set(reflect.ValueOf(trimmed))
+			return nil
+		}
+
+		if len(values) != 1 {
+			return fmt.Errorf("Expected a single value for %v, got %v", key, values)
+		}
+		value := strings.TrimSpace(values[0])
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			intValue, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("Expected a number for %v, got %v", key, value)
+			}
+			field.SetInt(int64(intValue))
+		}
+		return nil
+
+	}
+
+	return fmt.Errorf("Unknown config key: %v", key)
+
+}
+
+// Parse the subset of yaml needed for a flat config: "key: value" lines,
+// lists either inline ("key: [a, b]") or as "- item" lines below the key,
+// and # comments.  There is no yaml library in Godeps, and nesting is not
+// needed here.  Returns the scalar values and the lists separately.
+func parseSimpleYaml(contents []byte) (map[string]string, map[string][]string, error) {
+
+	values := map[string]string{}
+	lists := map[string][]string{}
+	listKey := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	lineNumber := 0
+	for scanner.Scan() {
+
+		lineNumber += 1
+		line := stripYamlComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" {
+				return nil, nil, fmt.Errorf("Line %v: list item without a key", lineNumber)
+			}
+			item := unquoteYaml(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			lists[listKey] = append(lists[listKey], item)
+			continue
+		}
+
+		if line != strings.TrimLeft(line, " \t") {
+			return nil, nil, fmt.Errorf("Line %v: nested values are not supported", lineNumber)
+		}
+
+		keyValueComponents := strings.SplitN(trimmed, ":", 2)
+		if len(keyValueComponents) != 2 {
+			return nil, nil, fmt.Errorf("Line %v: expected key: value", lineNumber)
+		}
+		key := strings.TrimSpace(keyValueComponents[0])
+		value := strings.TrimSpace(keyValueComponents[1])
+
+		switch {
+		case value == "":
+			// the list items follow on the next lines
+			listKey = key
+			lists[key] = []string{}
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			listKey = ""
+			items := []string{}
+			for _, item := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ",") {
+				items = append(items, unquoteYaml(strings.TrimSpace(item)))
+			}
+			lists[key] = items
+		default:
+			listKey = ""
+			values[key] = unquoteYaml(value)
+		}
+
+	}
+
+	return values, lists, scanner.Err()
+
+}
+
+// Remove a trailing # comment, unless the # is inside quotes
+func stripYamlComment(line string) string {
+
+	inQuote := rune(0)
+	for i, r := range line {
+		switch {
+		case inQuote != 0:
+			if r == inQuote {
+				inQuote = 0
+			}
+		case r == '"' || r == '\'':
+			inQuote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+
+}
+
+func unquoteYaml(value string) string {
+
+	if len(value) >= 2 {
+		first, last := value[0], value[len(value)-1]
+		if (first == '"' || first == '\'') && first == last {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+
+}
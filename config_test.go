@@ -0,0 +1,164 @@
+package cbcluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Write contents to a file called name in a new temp dir, and return its path
+func writeTempConfig(t *testing.T, name, contents string) string {
+
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(configPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+
+}
+
+func TestLoadConfigYamlLists(t *testing.T) {
+
+	configPath := writeTempConfig(t, "config.yaml", `
+# both kinds of list
+etcd_servers:
+  - http://10.0.0.1:4001
+  - "http://10.0.0.2:4001"
+fleet_endpoint: unix:///var/run/fleet.sock
+`)
+	defer os.RemoveAll(filepath.Dir(configPath))
+
+	config, err := LoadConfig(configPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"http://10.0.0.1:4001", "http://10.0.0.2:4001"}
+	if !reflect.DeepEqual(config.EtcdServers, expected) {
+		t.Fatalf("Expected block list %v, got %v", expected, config.EtcdServers)
+	}
+	if config.FleetEndpoint != "unix:///var/run/fleet.sock" {
+		t.Fatalf("Unexpected fleet endpoint: %v", config.FleetEndpoint)
+	}
+
+	inlinePath := writeTempConfig(t, "config.yml", `etcd_servers: [http://10.0.0.1:4001, 'http://10.0.0.2:4001']`)
+	defer os.RemoveAll(filepath.Dir(inlinePath))
+
+	config, err = LoadConfig(inlinePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.EtcdServers, expected) {
+		t.Fatalf("Expected inline list %v, got %v", expected, config.EtcdServers)
+	}
+
+}
+
+func TestLoadConfigYamlCommentInQuotes(t *testing.T) {
+
+	configPath := writeTempConfig(t, "config.yaml", `
+factory_admin_password: "pass#word" # the # in quotes is kept
+image_repo_prefix: 'repo#prefix'
+couchbase_port: 8092 # a trailing comment
+`)
+	defer os.RemoveAll(filepath.Dir(configPath))
+
+	config, err := LoadConfig(configPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.FactoryAdminPassword != "pass#word" {
+		t.Fatalf("Expected pass#word, got %q", config.FactoryAdminPassword)
+	}
+	if config.ImageRepoPrefix != "repo#prefix" {
+		t.Fatalf("Expected repo#prefix, got %q", config.ImageRepoPrefix)
+	}
+	if config.CouchbasePort != "8092" {
+		t.Fatalf("Expected 8092, got %q", config.CouchbasePort)
+	}
+
+}
+
+func TestLoadConfigJsonUnknownKey(t *testing.T) {
+
+	configPath := writeTempConfig(t, "config.json", `{"couchbase_port": "8092", "couchbase_prot": "8093"}`)
+	defer os.RemoveAll(filepath.Dir(configPath))
+
+	_, err := LoadConfig(configPath, nil)
+	if err == nil || !strings.Contains(err.Error(), "couchbase_prot") {
+		t.Fatalf("Expected an unknown key error naming couchbase_prot, got: %v", err)
+	}
+
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+
+	configPath := writeTempConfig(t, "config.json", `{"couchbase_port": "8092", "log_level": "debug"}`)
+	defer os.RemoveAll(filepath.Dir(configPath))
+
+	environ := []string{
+		"CBCLUSTER_COUCHBASE_PORT=8093",
+		"CBCLUSTER_ETCD_SERVERS=http://10.0.0.1:4001,http://10.0.0.2:4001",
+		"CBCLUSTER_SOMETHING_ELSE=ignored",
+		"PATH=/usr/bin",
+	}
+
+	config, err := LoadConfig(configPath, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CouchbasePort != "8093" {
+		t.Fatalf("Expected the environment to override the file's port, got %v", config.CouchbasePort)
+	}
+	if config.LogLevel != LOG_LEVEL_DEBUG {
+		t.Fatalf("Expected the file's log level, got %v", config.LogLevel)
+	}
+	if len(config.EtcdServers) != 2 {
+		t.Fatalf("Expected two etcd servers from the environment, got %v", config.EtcdServers)
+	}
+
+	if _, err := LoadConfig(configPath, []string{"CBCLUSTER_COUCHBASE_PORT=not-a-port"}); err == nil {
+		t.Fatalf("Expected an invalid port in the environment to fail validation")
+	}
+
+}
+
+func TestConfigValidate(t *testing.T) {
+
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("Expected the default config to be valid, got: %v", err)
+	}
+
+	invalidConfigs := map[string]func(config *Config){
+		"etcd server":       func(config *Config) { config.EtcdServers = []string{"not a url"} },
+		"fleet endpoint":    func(config *Config) { config.FleetEndpoint = "ftp://localhost/v1-alpha" },
+		"couchbase port":    func(config *Config) { config.CouchbasePort = "70000" },
+		"bucket ram":        func(config *Config) { config.DefaultBucketRamMB = 99 },
+		"replica number":    func(config *Config) { config.DefaultBucketReplicaNumber = MAX_REPLICA_NUMBER + 1 },
+		"factory username":  func(config *Config) { config.FactoryAdminUsername = "" },
+		"max retries":       func(config *Config) { config.MaxRetriesJoinCluster = 0 },
+		"image repo prefix": func(config *Config) { config.ImageRepoPrefix = "" },
+		"creds key file":    func(config *Config) { config.CredsKeyFile = "/nonexistent/creds.key" },
+		"log level":         func(config *Config) { config.LogLevel = "verbose" },
+		"log format":        func(config *Config) { config.LogFormat = "xml" },
+		"event ttl":         func(config *Config) { config.EventTtlSeconds = -1 },
+		"service manager":   func(config *Config) { config.ServiceManager = "upstart" },
+		"exec command":      func(config *Config) { config.ServiceManager = SERVICE_MANAGER_EXEC; config.CouchbaseExecCommand = " " },
+		"data volume":       func(config *Config) { config.DataVolume = "var/couchbase" },
+	}
+
+	for name, invalidate := range invalidConfigs {
+		config := DefaultConfig()
+		invalidate(&config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected an invalid %v to fail validation", name)
+		}
+	}
+
+}
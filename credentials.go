@@ -0,0 +1,403 @@
+package cbcluster
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// The credentials being rotated to.  Present only while a rotation is
+	// unfinished, so that running it again can tell where it left off.
+	KEY_USER_PASS_PENDING = "/couchbase.com/userpass-pending"
+
+	CREDENTIAL_RECORD_VERSION = 1
+)
+
+// The admin credentials as stored in etcd under /couchbase.com/userpass.
+// Either Username and Password are set, or, when a key file is configured,
+// Ciphertext holds them encrypted with AES-GCM.
+type CredentialRecord struct {
+	Version    int    `json:"version"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`      // base64
+	Ciphertext string `json:"ciphertext,omitempty"` // base64 of the encrypted {"username":..,"password":..}
+}
+
+// Split user:pass into the username and password.  Only the first colon
+// separates them, so the password may contain colons.
+func parseUserPass(userpassRaw string) (string, string, error) {
+
+	userpassComponents := strings.SplitN(userpassRaw, ":", 2)
+	if len(userpassComponents) != 2 || userpassComponents[0] == "" {
+		return "", "", fmt.Errorf("Invalid user/pass, expected user:pass")
+	}
+
+	return userpassComponents[0], userpassComponents[1], nil
+
+}
+
+// Encode the credentials as a record for etcd, encrypted if a key file is
+// configured (creds_key_file in the config).
+func EncodeCredentials(username, password string) (string, error) {
+
+	key, err := loadCredsKey()
+	if err != nil {
+		return "", err
+	}
+
+	record := CredentialRecord{Version: CREDENTIAL_RECORD_VERSION}
+
+	if key == nil {
+		record.Username = username
+		record.Password = password
+	} else {
+		plaintext, err := json.Marshal(CredentialRecord{Username: username, Password: password})
+		if err != nil {
+			return "", err
+		}
+		gcm, err := newCredsCipher(key)
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		record.Nonce = base64.StdEncoding.EncodeToString(nonce)
+		record.Ciphertext = base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil))
+	}
+
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	return string(recordJson), nil
+
+}
+
+// Decode the credentials stored in etcd.  Besides records written by
+// EncodeCredentials, this also accepts the plain user:pass of older versions.
+func DecodeCredentials(value string) (string, string, error) {
+
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		return parseUserPass(value)
+	}
+
+	record := CredentialRecord{}
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return "", "", fmt.Errorf("Invalid credential record: %v", err)
+	}
+	if record.Version != CREDENTIAL_RECORD_VERSION {
+		return "", "", fmt.Errorf("Unsupported credential record version: %v", record.Version)
+	}
+
+	if record.Ciphertext == "" {
+		if record.Username == "" {
+			return "", "", fmt.Errorf("Credential record has no username")
+		}
+		return record.Username, record.Password, nil
+	}
+
+	key, err := loadCredsKey()
+	if err != nil {
+		return "", "", err
+	}
+	if key == nil {
+		return "", "", fmt.Errorf("Credentials are encrypted, but no creds_key_file is configured")
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(record.Nonce)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid credential record nonce: %v", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(record.Ciphertext)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid credential record ciphertext: %v", err)
+	}
+
+	gcm, err := newCredsCipher(key)
+	if err != nil {
+		return "", "", err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return "", "", fmt.Errorf("Invalid credential record nonce size: %v", len(nonce))
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to decrypt credentials, wrong key file?")
+	}
+
+	decrypted := CredentialRecord{}
+	if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+		return "", "", fmt.Errorf("Invalid decrypted credentials: %v", err)
+	}
+
+	return decrypted.Username, decrypted.Password, nil
+
+}
+
+// Read the key from the configured key file, or nil if there is none.  The
+// key is the sha256 of the file contents, so any secret will do, ie the
+// output of: head -c 32 /dev/urandom | base64
+func loadCredsKey() ([]byte, error) {
+
+	if activeConfig.CredsKeyFile == "" {
+		return nil, nil
+	}
+
+	contents, err := ioutil.ReadFile(activeConfig.CredsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read creds key file: %v", err)
+	}
+
+	secret := strings.TrimSpace(string(contents))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Creds key file %v is empty", activeConfig.CredsKeyFile)
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+
+}
+
+func newCredsCipher(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+
+}
+
+// Change the admin credentials to newUserPass (user:pass).  The password is
+// first changed on the cluster via /settings/web, and then in etcd with a
+// compare and swap, so that a concurrent change is not overwritten.  If it
+// fails between the two steps, run it again with the same credentials to
+// finish.  Running node daemons reload the credentials from etcd.
+func RotateCredentials(etcdServers []string, newUserPass string) error {
+
+	newUsername, newPassword, err := parseUserPass(newUserPass)
+	if err != nil {
+		return err
+	}
+	RegisterSecret(newPassword)
+
+	couchbaseCluster := NewCouchbaseCluster(etcdServers)
+	StupidPortHack(couchbaseCluster)
+
+	response, err := couchbaseCluster.etcdClient.Get(KEY_USER_PASS, false, false)
+	if err != nil {
+		return err
+	}
+	oldRecord := response.Node.Value
+	oldIndex := response.Node.ModifiedIndex
+
+	oldUsername, oldPassword, err := DecodeCredentials(oldRecord)
+	if err != nil {
+		return err
+	}
+	RegisterSecret(oldPassword)
+
+	if oldUsername == newUsername && oldPassword == newPassword {
+		defaultLogger.Infof("Credentials in etcd are already up to date")
+		return couchbaseCluster.deletePendingUserPass()
+	}
+
+	newRecord, err := EncodeCredentials(newUsername, newPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := couchbaseCluster.setPendingUserPass(newRecord, newUsername, newPassword); err != nil {
+		return err
+	}
+
+	couchbaseCluster.AdminUsername = oldUsername
+	couchbaseCluster.AdminPassword = oldPassword
+
+	liveNodeIp, err := couchbaseCluster.FindLiveNode()
+	if err != nil {
+		return err
+	}
+	if liveNodeIp == "" {
+		return fmt.Errorf("No live node found in etcd")
+	}
+
+	// an earlier attempt may have changed the cluster but not etcd
+	newAccepted, err := couchbaseCluster.credsAccepted(liveNodeIp, newUsername, newPassword)
+	if err != nil {
+		return err
+	}
+
+	if newAccepted {
+		defaultLogger.Infof("Cluster already uses the new credentials, finishing an earlier rotation")
+	} else {
+		if err := couchbaseCluster.ChangeAdminCreds(liveNodeIp, newUsername, newPassword); err != nil {
+			return err
+		}
+		defaultLogger.Infof("Changed admin credentials on the cluster")
+	}
+
+	_, err = couchbaseCluster.etcdClient.CompareAndSwap(KEY_USER_PASS, newRecord, TTL_NONE, oldRecord, oldIndex)
+	if err != nil {
+		return fmt.Errorf(
+			"Changed the credentials on the cluster, but failed to update %v.  Run rotate-credentials again with the same credentials to finish: %v",
+			KEY_USER_PASS,
+			err,
+		)
+	}
+
+	defaultLogger.Infof("Updated credentials in etcd, node daemons will pick them up shortly")
+
+	return couchbaseCluster.deletePendingUserPass()
+
+}
+
+// Change the admin username and password of the cluster, authenticating
+// with the current credentials.
+//
+// Docs: http://docs.couchbase.com/admin/admin/REST/rest-node-set-username.html
+func (c CouchbaseCluster) ChangeAdminCreds(liveNodeIp, username, password string) error {
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/settings/web", liveNodeIp, c.LocalCouchbasePort)
+
+	data := url.Values{
+		"username": {username},
+		"password": {password},
+		"port":     {c.LocalCouchbasePort},
+	}
+
+	return c.POST(false, endpointUrl, data)
+
+}
+
+// Does the cluster accept these credentials?
+func (c CouchbaseCluster) credsAccepted(liveNodeIp, username, password string) (bool, error) {
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default", liveNodeIp, c.LocalCouchbasePort)
+
+	middleware := func(req *http.Request) {
+		req.SetBasicAuth(username, password)
+	}
+
+	jsonMap := map[string]interface{}{}
+	statusCode, err := getJsonDataStatusMiddleware(endpointUrl, &jsonMap, middleware)
+	if statusCode == http.StatusUnauthorized {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+// Record the credentials being rotated to.  Fails if a rotation to
+// different credentials is unfinished, since finishing that one first is
+// the only way to know which password the cluster has.
+func (c CouchbaseCluster) setPendingUserPass(newRecord, newUsername, newPassword string) error {
+
+	_, err := c.etcdClient.Create(KEY_USER_PASS_PENDING, newRecord, TTL_NONE)
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(err.Error(), "Key already exists") {
+		return err
+	}
+
+	response, err := c.etcdClient.Get(KEY_USER_PASS_PENDING, false, false)
+	if err != nil {
+		return err
+	}
+	// encrypted records differ every time, so compare what is in them
+	pendingUsername, pendingPassword, err := DecodeCredentials(response.Node.Value)
+	if err != nil {
+		return err
+	}
+	if pendingUsername != newUsername || pendingPassword != newPassword {
+		return fmt.Errorf(
+			"A rotation to different credentials is unfinished.  Run rotate-credentials with those first, or remove %v if it never reached the cluster",
+			KEY_USER_PASS_PENDING,
+		)
+	}
+
+	c.logger().Infof("Resuming unfinished credential rotation")
+	return nil
+
+}
+
+// Between rotate-credentials changing the cluster and updating
+// KEY_USER_PASS, the cluster only accepts the pending credentials.  If
+// there is a pending record, and a live node rejects username and password
+// with a 401 but accepts the pending ones, return the pending ones.
+// Otherwise return username and password unchanged.
+func (c CouchbaseCluster) pendingUserPassIfRotated(username, password string) (string, string, error) {
+
+	response, err := c.etcdClient.Get(KEY_USER_PASS_PENDING, false, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key not found") {
+			return username, password, nil
+		}
+		return "", "", err
+	}
+
+	pendingUsername, pendingPassword, err := DecodeCredentials(response.Node.Value)
+	if err != nil {
+		return "", "", err
+	}
+	RegisterSecret(pendingPassword)
+
+	if c.LocalCouchbasePort == "" {
+		StupidPortHack(&c)
+	}
+
+	liveNodeIp, err := c.FindLiveNode()
+	if err != nil {
+		return "", "", err
+	}
+	if liveNodeIp == "" {
+		// nothing to ask, and nothing to authenticate against either
+		return username, password, nil
+	}
+
+	accepted, err := c.credsAccepted(liveNodeIp, username, password)
+	if err != nil || accepted {
+		return username, password, err
+	}
+
+	pendingAccepted, err := c.credsAccepted(liveNodeIp, pendingUsername, pendingPassword)
+	if err != nil {
+		return "", "", err
+	}
+	if !pendingAccepted {
+		return username, password, nil
+	}
+
+	c.logger().Infof("Credentials in %v were rejected, using the ones of the unfinished rotation in %v", KEY_USER_PASS, KEY_USER_PASS_PENDING)
+	return pendingUsername, pendingPassword, nil
+
+}
+
+func (c CouchbaseCluster) deletePendingUserPass() error {
+
+	_, err := c.etcdClient.Delete(KEY_USER_PASS_PENDING, false)
+	if err != nil && !strings.Contains(err.Error(), "Key not found") {
+		return err
+	}
+	return nil
+
+}
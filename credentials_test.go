@@ -0,0 +1,168 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Configure a creds key file containing secret for the duration of a test.
+// Call the returned func to restore the config.
+func useCredsKeyFile(t *testing.T, secret string) func() {
+
+	dir, err := ioutil.TempDir("", "credentials_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "creds.key")
+	if err := ioutil.WriteFile(keyFile, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	savedConfig := activeConfig
+	activeConfig.CredsKeyFile = keyFile
+
+	return func() {
+		activeConfig = savedConfig
+		os.RemoveAll(dir)
+	}
+
+}
+
+func TestDecodeCredentialsLegacyUserPass(t *testing.T) {
+
+	username, password, err := DecodeCredentials("admin:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "admin" || password != "secret" {
+		t.Fatalf("Expected admin/secret, got %v/%v", username, password)
+	}
+
+	for _, invalid := range []string{"nocolon", ":password"} {
+		if _, _, err := DecodeCredentials(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+
+}
+
+func TestCredentialsPasswordWithColons(t *testing.T) {
+
+	username, password, err := DecodeCredentials("admin:pa:ss:word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "admin" || password != "pa:ss:word" {
+		t.Fatalf("Expected admin/pa:ss:word from the legacy format, got %v/%v", username, password)
+	}
+
+	record, err := EncodeCredentials("admin", "pa:ss:word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, password, err = DecodeCredentials(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "admin" || password != "pa:ss:word" {
+		t.Fatalf("Expected admin/pa:ss:word from the record, got %v/%v", username, password)
+	}
+
+}
+
+func TestCredentialsEncryptRoundTrip(t *testing.T) {
+
+	defer useCredsKeyFile(t, "the-creds-key")()
+
+	record, err := EncodeCredentials("admin", "s3cret:password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(record, "s3cret") || strings.Contains(record, "admin") {
+		t.Fatalf("Expected the record to be encrypted, got: %v", record)
+	}
+
+	decoded := CredentialRecord{}
+	if err := json.Unmarshal([]byte(record), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Ciphertext == "" || decoded.Nonce == "" || decoded.Version != CREDENTIAL_RECORD_VERSION {
+		t.Fatalf("Unexpected record: %+v", decoded)
+	}
+
+	username, password, err := DecodeCredentials(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "admin" || password != "s3cret:password" {
+		t.Fatalf("Expected admin/s3cret:password, got %v/%v", username, password)
+	}
+
+	// each record gets its own nonce
+	otherRecord, err := EncodeCredentials("admin", "s3cret:password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherRecord == record {
+		t.Fatalf("Expected two encryptions of the same credentials to differ")
+	}
+
+}
+
+func TestCredentialsWrongKey(t *testing.T) {
+
+	restore := useCredsKeyFile(t, "the-creds-key")
+	record, err := EncodeCredentials("admin", "secret")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer useCredsKeyFile(t, "another-key")()
+
+	if _, _, err := DecodeCredentials(record); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Fatalf("Expected decrypting with the wrong key to fail, got: %v", err)
+	}
+
+}
+
+func TestCredentialsEncryptedWithoutKey(t *testing.T) {
+
+	restore := useCredsKeyFile(t, "the-creds-key")
+	record, err := EncodeCredentials("admin", "secret")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := DecodeCredentials(record); err == nil {
+		t.Fatalf("Expected decoding an encrypted record without a key file to fail")
+	}
+
+}
+
+func TestFleetUnitPassesCredsKeyFile(t *testing.T) {
+
+	defer useCredsKeyFile(t, "the-creds-key")()
+
+	c := CouchbaseFleet{CbVersion: "3.0.1", ContainerTag: "latest"}
+
+	fleetUnitJson, err := c.generateFleetUnitJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CONFIG_ENV_PREFIX + "CREDS_KEY_FILE=" + CONTAINER_CREDS_KEY_FILE
+	if !strings.Contains(fleetUnitJson, expected) || !strings.Contains(fleetUnitJson, activeConfig.CredsKeyFile+":"+CONTAINER_CREDS_KEY_FILE) {
+		t.Fatalf("Expected the unit to mount the key file and set %v, got: %v", expected, fleetUnitJson)
+	}
+
+	c.UnitTemplate = "[Service]\nExecStart=/usr/bin/docker run {{ .IMAGE }}\n"
+	if _, err := c.generateFleetUnitJson(); err == nil {
+		t.Fatalf("Expected a template that does not pass the key file to be refused")
+	}
+
+}
@@ -0,0 +1,124 @@
+package cbcluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	MAX_RETRIES_UNITS_STOPPED = 30
+)
+
+// The etcd keys holding cluster state that this tool writes, which are
+// removed when the cluster is destroyed.  Keys the user writes to declare
+// what they want (design docs, xdcr specs, bucket replicas) are left alone.
+var CLUSTER_STATE_ETCD_KEYS = []string{
+	KEY_NODE_STATE,
+	KEY_USER_PASS,
+	KEY_USER_PASS_PENDING,
+	KEY_XDCR_STATE,
+	KEY_BACKUP_LOCK,
+	KEY_BACKUP_LAST,
+	KEY_SEED_DATA,
+	KEY_UPGRADE_STATE,
+	KEY_SYNC_GW_CONFIG,
+}
+
+// Find the names of all couchbase_node@N.service units in fleet
+func (c CouchbaseFleet) couchbaseUnitNames() ([]string, error) {
+
+	unitNumbers, err := c.couchbaseUnitNumbers()
+	if err != nil {
+		return nil, err
+	}
+
+	unitNames := []string{}
+	for _, unitNumber := range unitNumbers {
+		unitNames = append(unitNames, couchbaseUnitName(unitNumber))
+	}
+
+	return unitNames, nil
+
+}
+
+// Destroy all sync_gw_node and couchbase_node units, wait for them to stop
+// and remove the cluster state from etcd, so that launch-cbs can start from
+// a clean slate.  The sync gateways go first, since they need the cluster.
+func (c CouchbaseFleet) Destroy() error {
+
+	syncGwUnitNames, err := c.syncGwUnitNames()
+	if err != nil {
+		return err
+	}
+
+	couchbaseUnitNames, err := c.couchbaseUnitNames()
+	if err != nil {
+		return err
+	}
+
+	unitNames := append(syncGwUnitNames, couchbaseUnitNames...)
+
+	for _, unitName := range unitNames {
+		c.logger().Infof("Destroying unit: %v", unitName)
+		if err := c.fleetClient.DestroyUnit(unitName); err != nil {
+			return err
+		}
+	}
+
+	if err := c.waitUntilUnitsGone(unitNames); err != nil {
+		return err
+	}
+
+	for _, key := range CLUSTER_STATE_ETCD_KEYS {
+		c.logger().Infof("Removing etcd key: %v", key)
+		_, err := c.etcdClient.Delete(key, true)
+		if err != nil && !strings.Contains(err.Error(), "Key not found") {
+			return err
+		}
+	}
+
+	c.logger().Infof("Cluster destroyed")
+
+	return nil
+
+}
+
+// Wait until fleet no longer reports a state for any of the units.
+func (c CouchbaseFleet) waitUntilUnitsGone(unitNames []string) error {
+
+	isDestroyed := map[string]bool{}
+	for _, unitName := range unitNames {
+		isDestroyed[unitName] = true
+	}
+
+	worker := func() (bool, error) {
+
+		states, err := c.fleetClient.UnitStates()
+		if err != nil {
+			return false, err
+		}
+
+		for _, state := range states {
+			if isDestroyed[state.Name] {
+				c.logger().Infof("Unit %v still has state, waiting for it to stop", state.Name)
+				return false, nil
+			}
+		}
+		return true, nil
+
+	}
+
+	sleeper := func(numAttempts int) (bool, int) {
+		if numAttempts > MAX_RETRIES_UNITS_STOPPED {
+			return false, -1
+		}
+		return true, 2
+	}
+
+	if err := RetryLoop(worker, sleeper); err != nil {
+		return fmt.Errorf("Units did not stop: %v", err)
+	}
+
+	return nil
+
+}
@@ -0,0 +1,174 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+const (
+	// An in-order etcd directory of ClusterEvent json values.  Each event
+	// expires after event_ttl_seconds, so this is deliberately not one of
+	// the CLUSTER_STATE_ETCD_KEYS: the journal of a destroyed cluster stays
+	// around for a while, which is when it is most useful.
+	KEY_EVENTS = "/couchbase.com/events"
+
+	DEFAULT_EVENT_TTL_SECONDS = 7 * 24 * 60 * 60
+
+	EVENT_BECAME_FIRST_NODE   = "became-first-node"
+	EVENT_INITIALIZED         = "initialized"
+	EVENT_JOINED              = "joined"
+	EVENT_REBALANCE_STARTED   = "rebalance-started"
+	EVENT_REBALANCE_FINISHED  = "rebalance-finished"
+	EVENT_REBALANCE_FAILED    = "rebalance-failed"
+	EVENT_CREDENTIALS_LOADED  = "credentials-loaded"
+	EVENT_CREDENTIALS_CHANGED = "credentials-changed"
+	EVENT_FAILOVER            = "failover"
+)
+
+// An entry of the cluster event journal
+type ClusterEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Node    string    `json:"node,omitempty"` // the ip of the node daemon that recorded it, if any
+	Message string    `json:"message"`
+}
+
+// Append an event to the journal in etcd.  The journal is a diagnostic
+// aid, so failing to write to it is logged rather than returned.
+func (c CouchbaseCluster) RecordEvent(eventType, format string, args ...interface{}) {
+
+	event := ClusterEvent{
+		Time:    time.Now().UTC(),
+		Type:    eventType,
+		Node:    c.LocalCouchbaseIp,
+		Message: RedactSecrets(fmt.Sprintf(format, args...)),
+	}
+
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		c.logger().Warnf("Failed to encode %v event: %v", eventType, err)
+		return
+	}
+
+	ttlSeconds := uint64(activeConfig.EventTtlSeconds)
+	if _, err := c.etcdClient.CreateInOrder(KEY_EVENTS, string(eventJson), ttlSeconds); err != nil {
+		c.logger().Warnf("Failed to record %v event in %v: %v", eventType, KEY_EVENTS, err)
+	}
+
+}
+
+// Get the events in the journal, oldest first, and the etcd index to watch
+// from for newer ones.
+func (c CouchbaseCluster) Events() ([]ClusterEvent, uint64, error) {
+
+	events := []ClusterEvent{}
+
+	// in-order keys are zero padded, so sorting by key sorts by age
+	response, err := c.etcdClient.Get(KEY_EVENTS, true, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key not found") {
+			return events, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	for _, node := range response.Node.Nodes {
+		event, err := decodeEvent(node)
+		if err != nil {
+			c.logger().Warnf("%v", err)
+			continue
+		}
+		events = append(events, event)
+	}
+
+	return events, response.EtcdIndex + 1, nil
+
+}
+
+// Write the events in the journal to w, and if follow is true, keep
+// watching etcd and write new events as they are recorded.
+func WriteEvents(etcdServers []string, w io.Writer, format string, follow bool) error {
+
+	couchbaseCluster := NewCouchbaseCluster(etcdServers)
+
+	events, waitIndex, err := couchbaseCluster.Events()
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if err := event.Write(w, format); err != nil {
+			return err
+		}
+	}
+
+	if !follow {
+		return nil
+	}
+
+	receiver := make(chan *etcd.Response)
+	watchErrs := make(chan error, 1)
+	go func() {
+		_, err := couchbaseCluster.etcdClient.Watch(KEY_EVENTS, waitIndex, true, receiver, nil)
+		watchErrs <- err
+	}()
+
+	// Watch closes the receiver when it returns
+	for response := range receiver {
+		if response.Action != "create" {
+			continue // ie, an event expiring
+		}
+		event, err := decodeEvent(response.Node)
+		if err != nil {
+			couchbaseCluster.logger().Warnf("%v", err)
+			continue
+		}
+		if err := event.Write(w, format); err != nil {
+			return err
+		}
+	}
+
+	return <-watchErrs
+
+}
+
+// Write the event as a line of text or json
+func (event ClusterEvent) Write(w io.Writer, format string) error {
+
+	if err := validateOutputFormat(format); err != nil {
+		return err
+	}
+	if format == OUTPUT_FORMAT_JSON {
+		return writeJson(w, event, false)
+	}
+
+	node := event.Node
+	if node == "" {
+		node = "-"
+	}
+	_, err := fmt.Fprintf(
+		w,
+		"%v  %-19v  %-15v  %v\n",
+		event.Time.Format(time.RFC3339),
+		event.Type,
+		node,
+		event.Message,
+	)
+	return err
+
+}
+
+func decodeEvent(node *etcd.Node) (ClusterEvent, error) {
+
+	event := ClusterEvent{}
+	if err := json.Unmarshal([]byte(node.Value), &event); err != nil {
+		return event, fmt.Errorf("Event %v is not valid json, skipping: %v", node.Key, err)
+	}
+	return event, nil
+
+}
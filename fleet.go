@@ -2,50 +2,87 @@ package cbcluster
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"html/template"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/coreos/go-etcd/etcd"
 )
 
 const (
-	FLEET_API_ENDPOINT = "http://localhost:49153/v1-alpha"
+	FLEET_API_ENDPOINT        = "http://localhost:49153/v1-alpha"
+	DEFAULT_IMAGE_REPO_PREFIX = "tleyden5iwx/couchbase-server"
+	DEFAULT_DATA_VOLUME       = "/opt/couchbase/var"
+	COUCHBASE_VAR_DIR         = "/opt/couchbase/var"
+	CONTAINER_CREDS_KEY_FILE  = "/etc/couchbase-cluster/creds.key" // where the creds key file is mounted in the container
 )
 
 type CouchbaseFleet struct {
-	etcdClient          *etcd.Client
-	UserPass            string
-	NumNodes            int
-	CbVersion           string
-	ContainerTag        string // Docker tag
-	EtcdServers         []string
-	SkipCleanSlateCheck bool
+	etcdClient           *etcd.Client
+	Logger               Logger // if nil, use the default logger
+	fleetClient          *FleetClient
+	FleetEndpoint        string // http url or unix:// socket of the fleet api
+	UserPass             string
+	NumNodes             int
+	CbVersion            string
+	ContainerTag         string // Docker tag
+	EtcdServers          []string
+	SkipCleanSlateCheck  bool
+	UnitTemplate         string   // systemd unit or fleet unit json.  If empty, use the default
+	ImageRepo            string   // If empty, use tleyden5iwx/couchbase-server-<version>
+	DataVolume           string   // Host path mounted as /opt/couchbase/var
+	ExtraDockerArgs      string   // Appended to the docker run args
+	MemoryLimit          string   // ie, 2g
+	Environment          []string // KEY=VALUE pairs passed to the container
+	MachineMetadata      []string // key=value selectors of the machines couchbase may run on
+	OutputFormat         string   // format of the launch summary, text or json
+	OutputFile           string   // write the launch summary here instead of stdout
+	SyncGwImageRepo      string   // If empty, use couchbase/sync-gateway
+	SyncGwBucket         string   // If empty, use the default bucket
+	SyncGwConfigTemplate string   // sync gateway config json template.  If empty, use the default
 }
 
 // this is used in the fleet template.
 // TODO: should use anon struct
 type FleetParams struct {
-	CB_VERSION    string
-	CONTAINER_TAG string
+	CB_VERSION         string
+	CONTAINER_TAG      string
+	IMAGE_REPO         string
+	IMAGE              string // IMAGE_REPO:CONTAINER_TAG
+	DATA_VOLUME        string
+	MEMORY_LIMIT       string
+	ENVIRONMENT        []string
+	EXTRA_DOCKER_ARGS  string
+	DOCKER_RUN_OPTIONS string // volume, networking, memory, env and extra args combined
 }
 
+// Create a CouchbaseFleet using the configured fleet endpoint.  Call
+// ConnectToFleet before using it, once c.FleetEndpoint is final.
 func NewCouchbaseFleet(etcdServers []string) *CouchbaseFleet {
 
 	c := &CouchbaseFleet{}
 
+	if len(etcdServers) == 0 {
+		etcdServers = activeConfig.EtcdServers
+	}
+
 	if len(etcdServers) > 0 {
 		c.EtcdServers = etcdServers
-		log.Printf("Connect to explict etcd servers: %v", c.EtcdServers)
+		defaultLogger.Infof("Connect to explict etcd servers: %v", c.EtcdServers)
 	} else {
 		c.EtcdServers = []string{}
-		log.Printf("Connect to etcd on localhost")
+		defaultLogger.Infof("Connect to etcd on localhost")
 	}
 	c.ConnectToEtcd()
+
+	c.FleetEndpoint = activeConfig.FleetEndpoint
+
 	return c
 
 }
@@ -56,52 +93,162 @@ func (c *CouchbaseFleet) ConnectToEtcd() {
 	c.etcdClient.SetConsistency(etcd.STRONG_CONSISTENCY)
 }
 
+// Create the fleet client for c.FleetEndpoint.  Call this again after
+// changing c.FleetEndpoint.
+func (c *CouchbaseFleet) ConnectToFleet() error {
+
+	fleetClient, err := NewFleetClient(c.FleetEndpoint, DEFAULT_FLEET_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	c.fleetClient = fleetClient
+	return nil
+
+}
+
+// Launch c.NumNodes couchbase_node@N.service units and wait until the
+// cluster is up.  If a previous launch with the same version and
+// credentials was interrupted, only the missing units are submitted, so
+// that it is always safe to run again.
 func (c *CouchbaseFleet) LaunchCouchbaseServer() error {
 
 	if err := c.verifyEnoughMachinesAvailable(); err != nil {
 		return err
 	}
 
-	// create an etcd client
-
-	// this need to check:
-	//   no etcd key for /couchbase.com
-	//   what else?
-	if err := c.verifyCleanSlate(); err != nil {
+	fleetUnitJson, err := c.generateFleetUnitJson()
+	if err != nil {
 		return err
 	}
 
-	if err := c.setUserNamePassEtcd(); err != nil {
+	existingUnitNumbers, err := c.verifyResumableLaunch(fleetUnitJson)
+	if err != nil {
 		return err
 	}
 
-	for i := 1; i < c.NumNodes+1; i++ {
+	if len(existingUnitNumbers) == 0 {
 
-		fleetUnitJson, err := c.generateFleetUnitJson()
-		if err != nil {
+		// this need to check:
+		//   no etcd key for /couchbase.com
+		//   what else?
+		if err := c.verifyCleanSlate(); err != nil {
 			return err
 		}
-		if err := submitAndLaunchFleetUnitN(i, fleetUnitJson); err != nil {
+
+		if err := c.setUserNamePassEtcd(); err != nil {
+			return err
+		}
+
+	} else {
+		c.logger().Infof("Resuming launch, units already submitted: %v", existingUnitNumbers)
+	}
+
+	isExisting := map[int]bool{}
+	for _, unitNumber := range existingUnitNumbers {
+		isExisting[unitNumber] = true
+	}
+
+	unitNames := []string{}
+	for i := 1; i < c.NumNodes+1; i++ {
+
+		unitNames = append(unitNames, couchbaseUnitName(i))
+		if isExisting[i] {
+			continue
+		}
+		if err := c.submitAndLaunchFleetUnitN(i, fleetUnitJson); err != nil {
 			return err
 		}
 
 	}
 
+	// make sure the units actually started, since a failed unit would
+	// otherwise leave us waiting for the cluster forever
+	if err := c.waitUntilUnitsActive(unitNames); err != nil {
+		return err
+	}
+
 	// wait until X nodes are up in cluster
-	log.Printf("Waiting for cluster to be up ..")
-	WaitUntilNumNodesRunning(c.NumNodes, c.EtcdServers)
+	c.logger().Infof("Waiting for cluster to be up ..")
+	if err := WaitUntilNumNodesRunning(c.NumNodes, c.EtcdServers); err != nil {
+		return err
+	}
 
 	// let user know its up
 
-	log.Printf("Cluster is up!")
+	c.logger().Infof("Cluster is up!")
 
-	return nil
+	return c.reportLaunchSummary()
+
+}
+
+// Find the units left behind by an earlier launch, and make sure that
+// launch asked for the same thing: the same credentials, and units rendered
+// for the same version and settings.  Returns the numbers of the existing
+// units, which is empty when starting from scratch.
+func (c CouchbaseFleet) verifyResumableLaunch(fleetUnitJson string) ([]int, error) {
+
+	unitNumbers, err := c.couchbaseUnitNumbers()
+	if err != nil {
+		return nil, err
+	}
+	if len(unitNumbers) == 0 {
+		return unitNumbers, nil
+	}
+
+	response, err := c.etcdClient.Get(KEY_USER_PASS, false, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key not found") {
+			return nil, fmt.Errorf(
+				"Found units %v but no credentials in etcd.  Run couchbase-fleet destroy first",
+				unitNumbers,
+			)
+		}
+		return nil, err
+	}
+	existingUsername, existingPassword, err := DecodeCredentials(response.Node.Value)
+	if err != nil {
+		return nil, err
+	}
+	username, password, err := parseUserPass(c.UserPass)
+	if err != nil {
+		return nil, err
+	}
+	if existingUsername != username || existingPassword != password {
+		return nil, fmt.Errorf("Existing cluster was launched with different credentials.  Run couchbase-fleet destroy first")
+	}
+
+	for _, unitNumber := range unitNumbers {
+
+		if unitNumber > c.NumNodes {
+			return nil, fmt.Errorf(
+				"Found unit %v, but only %v nodes requested.  Use couchbase-fleet scale to shrink the cluster",
+				couchbaseUnitName(unitNumber),
+				c.NumNodes,
+			)
+		}
+
+		matches, err := c.fleetUnitMatches(couchbaseUnitName(unitNumber), fleetUnitJson)
+		if err != nil {
+			return nil, err
+		}
+		if !matches {
+			return nil, fmt.Errorf(
+				"Existing unit %v does not match version %v:%v or the requested unit settings.  Use couchbase-fleet upgrade, or destroy first",
+				couchbaseUnitName(unitNumber),
+				c.CbVersion,
+				c.ContainerTag,
+			)
+		}
+
+	}
+
+	return unitNumbers, nil
 
 }
 
 func (c *CouchbaseFleet) ExtractDocOptArgs(arguments map[string]interface{}) error {
 
-	userpass, err := ExtractUserPass(arguments)
+	userpass, err := ExtractUserPassOrFile(arguments)
 	if err != nil {
 		return err
 	}
@@ -109,16 +256,56 @@ func (c *CouchbaseFleet) ExtractDocOptArgs(arguments map[string]interface{}) err
 	if err != nil {
 		return err
 	}
+
+	c.UserPass = userpass
+	c.NumNodes = numnodes
+	c.SkipCleanSlateCheck = ExtractSkipCheckCleanState(arguments)
+	c.OutputFile, _ = ExtractStringArg(arguments, "--output-file")
+
+	c.OutputFormat, _ = ExtractStringArg(arguments, "--output")
+	if err := validateOutputFormat(c.OutputFormat); err != nil {
+		return err
+	}
+
+	return c.ExtractUnitDocOptArgs(arguments)
+}
+
+// Extract the args that control how units are rendered: the couchbase
+// version, docker tag, unit template and image settings.
+func (c *CouchbaseFleet) ExtractUnitDocOptArgs(arguments map[string]interface{}) error {
+
 	cbVersion, err := ExtractCbVersion(arguments)
 	if err != nil {
 		return err
 	}
 
-	c.UserPass = userpass
-	c.NumNodes = numnodes
 	c.CbVersion = cbVersion
 	c.ContainerTag = ExtractDockerTagOrLatest(arguments)
-	c.SkipCleanSlateCheck = ExtractSkipCheckCleanState(arguments)
+
+	if templateFile, err := ExtractStringArg(arguments, "--template"); err == nil {
+		unitTemplate, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return err
+		}
+		c.UnitTemplate = string(unitTemplate)
+	}
+	c.ImageRepo, _ = ExtractStringArg(arguments, "--image-repo")
+	c.DataVolume, _ = ExtractStringArg(arguments, "--data-volume")
+	c.ExtraDockerArgs, _ = ExtractStringArg(arguments, "--docker-run-args")
+	c.MemoryLimit, _ = ExtractStringArg(arguments, "--memory-limit")
+	c.Environment = ExtractCommaSeparatedArg(arguments, "--env")
+
+	if selectors, err := ExtractStringArg(arguments, "--machine-metadata"); err == nil {
+		c.MachineMetadata, err = ParseMachineMetadata(selectors)
+		if err != nil {
+			return err
+		}
+	}
+
+	// fail early, rather than after having checked machines and etcd
+	if _, err := c.generateFleetUnitJson(); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -127,28 +314,35 @@ func (c *CouchbaseFleet) ExtractDocOptArgs(arguments map[string]interface{}) err
 // the user asked to kick off is LTE number of machines on cluster
 func (c CouchbaseFleet) verifyEnoughMachinesAvailable() error {
 
-	log.Printf("verifyEnoughMachinesAvailable()")
+	c.logger().Infof("verifyEnoughMachinesAvailable()")
 
-	endpointUrl := fmt.Sprintf("%v/machines", FLEET_API_ENDPOINT)
-
-	// {"machines":[{"id":"a91c394439734375aa256d7da1410132","primaryIP":"172.17.8.101"}]}
-	jsonMap := map[string]interface{}{}
-	if err := getJsonData(endpointUrl, &jsonMap); err != nil {
-		log.Printf("getJsonData error: %v", err)
+	machines, err := c.fleetClient.Machines()
+	if err != nil {
+		c.logger().Warnf("Machines error: %v", err)
 		return err
 	}
 
-	machineListRaw := jsonMap["machines"]
-	machineList, ok := machineListRaw.([]interface{})
-	if !ok {
-		return fmt.Errorf("Unexpected value for machines: %v", jsonMap)
+	// only count the machines couchbase is allowed to run on
+	numMatching := 0
+	for _, machine := range machines {
+		if machineMatchesMetadata(machine, c.MachineMetadata) {
+			numMatching += 1
+		}
 	}
 
-	if len(machineList) < c.NumNodes {
-		return fmt.Errorf("User requested %v nodes, only %v available", c.NumNodes, len(machineList))
+	if numMatching < c.NumNodes {
+		if len(c.MachineMetadata) > 0 {
+			return fmt.Errorf(
+				"User requested %v nodes, only %v available with metadata %v",
+				c.NumNodes,
+				numMatching,
+				strings.Join(c.MachineMetadata, ","),
+			)
+		}
+		return fmt.Errorf("User requested %v nodes, only %v available", c.NumNodes, numMatching)
 	}
 
-	log.Printf("/verifyEnoughMachinesAvailable()")
+	c.logger().Infof("/verifyEnoughMachinesAvailable()")
 
 	return nil
 }
@@ -166,7 +360,7 @@ func (c CouchbaseFleet) verifyCleanSlate() error {
 
 	// if that key exists, there is residue and we should abort
 	if err == nil {
-		return fmt.Errorf("Found residue -- key: %v in etcd.  Destroy cluster first", KEY_NODE_STATE)
+		return fmt.Errorf("Found residue -- key: %v in etcd.  Run couchbase-fleet destroy first", KEY_NODE_STATE)
 	}
 
 	// if we get an error with "key not found", then we are starting
@@ -183,71 +377,70 @@ func (c CouchbaseFleet) verifyCleanSlate() error {
 
 func (c CouchbaseFleet) setUserNamePassEtcd() error {
 
-	_, err := c.etcdClient.Set(KEY_USER_PASS, c.UserPass, 0)
+	username, password, err := parseUserPass(c.UserPass)
+	if err != nil {
+		return err
+	}
+
+	record, err := EncodeCredentials(username, password)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.etcdClient.Set(KEY_USER_PASS, record, 0)
 
 	return err
 
 }
 
-func (c CouchbaseFleet) generateFleetUnitJson() (string, error) {
-	// run fleet template through templating engine, passing couchbase version,
-	// and save files to temp directory
-	fleetUnitJsonTemplate := `
-{
-    "desiredState":"launched",
-    "options":[
-        {
-            "section":"Service",
-            "name":"TimeoutStartSec",
-            "value":"0"
-        },
-        {
-            "section":"Service",
-            "name":"EnvironmentFile",
-            "value":"/etc/environment"
-        },
-        {
-            "section":"Service",
-            "name":"ExecStartPre",
-            "value":"-/usr/bin/docker kill couchbase"
-        },
-        {
-            "section":"Service",
-            "name":"ExecStartPre",
-            "value":"-/usr/bin/docker rm couchbase"
-        },
-        {
-            "section":"Service",
-            "name":"ExecStartPre",
-            "value":"/usr/bin/docker pull tleyden5iwx/couchbase-server-{{ .CB_VERSION }}:{{ .CONTAINER_TAG }}"
-        },
-        {
-            "section":"Service",
-            "name":"ExecStart",
-            "value":"/bin/bash -c '/usr/bin/docker run --name couchbase -v /opt/couchbase/var:/opt/couchbase/var --net=host tleyden5iwx/couchbase-server-{{ .CB_VERSION }}:{{ .CONTAINER_TAG }} couchbase-cluster start-couchbase-node --local-ip=$COREOS_PRIVATE_IPV4'"
-        },
-        {
-            "section":"Service",
-            "name":"ExecStop",
-            "value":"/usr/bin/docker stop couchbase"
-        },
-        {
-            "section":"X-Fleet",
-            "name":"Conflicts",
-            "value":"couchbase_node*.service"
-        }
-    ]
-}
+// The default unit, used unless the user supplies a template.  It is a
+// systemd unit that gets converted into fleet unit json.
+const DEFAULT_FLEET_UNIT_TEMPLATE = `
+[Service]
+TimeoutStartSec=0
+EnvironmentFile=/etc/environment
+ExecStartPre=-/usr/bin/docker kill couchbase
+ExecStartPre=-/usr/bin/docker rm couchbase
+ExecStartPre=/usr/bin/docker pull {{ .IMAGE }}
+ExecStart=/bin/bash -c '/usr/bin/docker run --name couchbase {{ .DOCKER_RUN_OPTIONS }} {{ .IMAGE }} couchbase-cluster start-couchbase-node --local-ip=$COREOS_PRIVATE_IPV4'
+ExecStop=/usr/bin/docker stop couchbase
+
+[X-Fleet]
+Conflicts=couchbase_node*.service
 `
 
-	tmpl, err := template.New("couchbase_fleet").Parse(fleetUnitJsonTemplate)
+func (c CouchbaseFleet) generateFleetUnitJson() (string, error) {
+
+	unitTemplate := c.UnitTemplate
+	if unitTemplate == "" {
+		unitTemplate = DEFAULT_FLEET_UNIT_TEMPLATE
+	}
+
+	fleetUnitJson, err := renderFleetUnitJson(unitTemplate, c.fleetParams(), c.MachineMetadata)
 	if err != nil {
 		return "", err
 	}
 
-	params := FleetParams{
-		CB_VERSION:    c.CbVersion,
-		CONTAINER_TAG: c.ContainerTag,
+	// otherwise every node daemon fails to read the encrypted credentials
+	if activeConfig.CredsKeyFile != "" && !strings.Contains(fleetUnitJson, CONTAINER_CREDS_KEY_FILE) {
+		return "", fmt.Errorf(
+			"The unit template does not pass the creds key file to the node daemons.  Use {{ .DOCKER_RUN_OPTIONS }} in it, or mount the key at %v and set CBCLUSTER_CREDS_KEY_FILE to that path",
+			CONTAINER_CREDS_KEY_FILE,
+		)
+	}
+
+	return fleetUnitJson, nil
+
+}
+
+// Render a unit template into validated fleet unit json, adding placement
+// constraints for the machine metadata.
+func renderFleetUnitJson(unitTemplate string, params interface{}, machineMetadata []string) (string, error) {
+	// run fleet template through templating engine, passing couchbase version,
+	// image settings, etc.
+	tmpl, err := template.New("couchbase_fleet").Parse(unitTemplate)
+	if err != nil {
+		return "", err
 	}
 
 	out := &bytes.Buffer{}
@@ -258,39 +451,356 @@ func (c CouchbaseFleet) generateFleetUnitJson() (string, error) {
 		return "", err
 	}
 
-	return out.String(), nil
+	// templates can either be fleet unit json or systemd units
+	rendered := strings.TrimSpace(out.String())
+	if !strings.HasPrefix(rendered, "{") {
+		rendered, err = systemdUnitToFleetJson(rendered)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(machineMetadata) > 0 {
+		rendered, err = addMachineMetadataConstraints(rendered, machineMetadata)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := validateFleetUnitJson(rendered); err != nil {
+		return "", err
+	}
+
+	return rendered, nil
 
 }
 
-func submitAndLaunchFleetUnitN(unitNumber int, fleetUnitJson string) error {
+// Add an X-Fleet MachineMetadata option for each key=value selector, so
+// that fleet only schedules the unit on machines with all of that metadata.
+func addMachineMetadataConstraints(fleetUnitJson string, machineMetadata []string) (string, error) {
 
-	client := &http.Client{}
+	fleetUnit := FleetUnit{}
+	if err := json.Unmarshal([]byte(fleetUnitJson), &fleetUnit); err != nil {
+		return "", fmt.Errorf("Fleet unit is not valid json: %v.  Unit: %v", err, fleetUnitJson)
+	}
 
-	endpointUrl := fmt.Sprintf("%v/units/couchbase_node@%v.service", FLEET_API_ENDPOINT, unitNumber)
+	for _, selector := range machineMetadata {
+		fleetUnit.Options = append(fleetUnit.Options, FleetUnitOption{
+			Section: "X-Fleet",
+			Name:    "MachineMetadata",
+			Value:   selector,
+		})
+	}
 
-	req, err := http.NewRequest("PUT", endpointUrl, bytes.NewReader([]byte(fleetUnitJson)))
+	constrainedJson, err := json.MarshalIndent(fleetUnit, "", "    ")
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	return string(constrainedJson), nil
 
-	resp, err := client.Do(req)
+}
+
+// Parse a comma separated list of key=value machine metadata selectors,
+// ie: role=couchbase,disk=ssd
+func ParseMachineMetadata(selectors string) ([]string, error) {
+
+	machineMetadata := []string{}
+
+	for _, selector := range strings.Split(selectors, ",") {
+		selector = strings.TrimSpace(selector)
+		if selector == "" {
+			continue
+		}
+		keyValue := strings.SplitN(selector, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" || keyValue[1] == "" {
+			return nil, fmt.Errorf("Invalid machine metadata selector, expected key=value: %v", selector)
+		}
+		machineMetadata = append(machineMetadata, selector)
+	}
+
+	return machineMetadata, nil
+
+}
+
+// Find the MachineMetadata constraints of an existing unit
+func unitMachineMetadata(fleetUnit FleetUnit) []string {
+
+	machineMetadata := []string{}
+	for _, option := range fleetUnit.Options {
+		if option.Section == "X-Fleet" && option.Name == "MachineMetadata" {
+			machineMetadata = append(machineMetadata, option.Value)
+		}
+	}
+	return machineMetadata
+
+}
+
+// Does the machine have all of the key=value metadata?
+func machineMatchesMetadata(machine FleetMachine, machineMetadata []string) bool {
+
+	for _, selector := range machineMetadata {
+		keyValue := strings.SplitN(selector, "=", 2)
+		if len(keyValue) != 2 || machine.Metadata[keyValue[0]] != keyValue[1] {
+			return false
+		}
+	}
+	return true
+
+}
+
+func (c CouchbaseFleet) fleetParams() FleetParams {
+
+	imageRepo := c.ImageRepo
+	if imageRepo == "" {
+		imageRepo = fmt.Sprintf("%v-%v", activeConfig.ImageRepoPrefix, c.CbVersion)
+	}
+
+	dataVolume := c.DataVolume
+	if dataVolume == "" {
+		dataVolume = activeConfig.DataVolume
+	}
+
+	dockerRunOptions := []string{
+		fmt.Sprintf("-v %v:%v", dataVolume, COUCHBASE_VAR_DIR),
+		"--net=host",
+	}
+	if c.MemoryLimit != "" {
+		dockerRunOptions = append(dockerRunOptions, fmt.Sprintf("--memory=%v", c.MemoryLimit))
+	}
+	for _, envVar := range c.Environment {
+		dockerRunOptions = append(dockerRunOptions, fmt.Sprintf("-e %v", envVar))
+	}
+	if c.ExtraDockerArgs != "" {
+		dockerRunOptions = append(dockerRunOptions, c.ExtraDockerArgs)
+	}
+
+	// the node daemons decrypt the credentials with the same key, which
+	// each machine must have at the same path as the launching one
+	if activeConfig.CredsKeyFile != "" {
+		credsKeyFile, err := filepath.Abs(activeConfig.CredsKeyFile)
+		if err != nil {
+			credsKeyFile = activeConfig.CredsKeyFile
+		}
+		dockerRunOptions = append(
+			dockerRunOptions,
+			fmt.Sprintf("-v %v:%v:ro", credsKeyFile, CONTAINER_CREDS_KEY_FILE),
+			fmt.Sprintf("-e %vCREDS_KEY_FILE=%v", CONFIG_ENV_PREFIX, CONTAINER_CREDS_KEY_FILE),
+		)
+	}
+
+	return FleetParams{
+		CB_VERSION:         c.CbVersion,
+		CONTAINER_TAG:      c.ContainerTag,
+		IMAGE_REPO:         imageRepo,
+		IMAGE:              fmt.Sprintf("%v:%v", imageRepo, c.ContainerTag),
+		DATA_VOLUME:        dataVolume,
+		MEMORY_LIMIT:       c.MemoryLimit,
+		ENVIRONMENT:        c.Environment,
+		EXTRA_DOCKER_ARGS:  c.ExtraDockerArgs,
+		DOCKER_RUN_OPTIONS: strings.Join(dockerRunOptions, " "),
+	}
+
+}
+
+// Convert a systemd unit into fleet unit json, with one option per
+// Name=Value line, in the order they appear.
+func systemdUnitToFleetJson(unit string) (string, error) {
+
+	fleetUnit := FleetUnit{
+		DesiredState: "launched",
+		Options:      []FleetUnitOption{},
+	}
+
+	section := ""
+	pending := ""
+
+	for i, line := range strings.Split(unit, "\n") {
+
+		line = strings.TrimSpace(line)
+
+		// a trailing backslash continues the value on the next line
+		if strings.HasSuffix(line, "\\") {
+			pending += strings.TrimSpace(strings.TrimSuffix(line, "\\")) + " "
+			continue
+		}
+		line = pending + line
+		pending = ""
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			continue
+		}
+
+		if section == "" {
+			return "", fmt.Errorf("Line %v of unit is outside of any section: %v", i+1, line)
+		}
+
+		nameValue := strings.SplitN(line, "=", 2)
+		if len(nameValue) != 2 {
+			return "", fmt.Errorf("Line %v of unit is not Name=Value: %v", i+1, line)
+		}
+
+		fleetUnit.Options = append(fleetUnit.Options, FleetUnitOption{
+			Section: section,
+			Name:    strings.TrimSpace(nameValue[0]),
+			Value:   strings.TrimSpace(nameValue[1]),
+		})
+
+	}
+
+	fleetUnitJson, err := json.MarshalIndent(fleetUnit, "", "    ")
 	if err != nil {
+		return "", err
+	}
+
+	return string(fleetUnitJson), nil
+
+}
+
+// Make sure fleetUnitJson is something fleet will accept as a unit
+func validateFleetUnitJson(fleetUnitJson string) error {
+
+	fleetUnit := FleetUnit{}
+	if err := json.Unmarshal([]byte(fleetUnitJson), &fleetUnit); err != nil {
+		return fmt.Errorf("Fleet unit is not valid json: %v.  Unit: %v", err, fleetUnitJson)
+	}
+
+	switch fleetUnit.DesiredState {
+	case "inactive", "loaded", "launched":
+	default:
+		return fmt.Errorf("Fleet unit has invalid desiredState: %q", fleetUnit.DesiredState)
+	}
+
+	hasExecStart := false
+	for _, option := range fleetUnit.Options {
+		if option.Section == "" || option.Name == "" {
+			return fmt.Errorf("Fleet unit option is missing a section or name: %+v", option)
+		}
+		if option.Section == "Service" && option.Name == "ExecStart" {
+			hasExecStart = true
+		}
+	}
+	if !hasExecStart {
+		return fmt.Errorf("Fleet unit has no ExecStart in the Service section")
+	}
+
+	return nil
+
+}
+
+func (c CouchbaseFleet) submitAndLaunchFleetUnitN(unitNumber int, fleetUnitJson string) error {
+
+	fleetUnit := FleetUnit{}
+	if err := json.Unmarshal([]byte(fleetUnitJson), &fleetUnit); err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
-	bodyStr, err := ioutil.ReadAll(resp.Body)
+	unitName := couchbaseUnitName(unitNumber)
+
+	c.logger().Infof("Submitting unit: %v", unitName)
+
+	return c.fleetClient.CreateUnit(unitName, fleetUnit)
+
+}
+
+// Find the numbers N of the couchbase_node@N.service units in fleet, lowest first
+func (c CouchbaseFleet) couchbaseUnitNumbers() ([]int, error) {
+
+	units, err := c.fleetClient.Units()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Printf("response body: %v", string(bodyStr))
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("Unexpected status code in response")
+	unitNumbers := []int{}
+	for _, unit := range units {
+		unitNumber, ok := couchbaseUnitNumber(unit.Name)
+		if !ok {
+			continue
+		}
+		unitNumbers = append(unitNumbers, unitNumber)
 	}
 
-	return nil
+	sort.Ints(unitNumbers)
+
+	return unitNumbers, nil
+
+}
+
+// Parse N out of couchbase_node@N.service
+func couchbaseUnitNumber(unitName string) (int, bool) {
+
+	if !strings.HasPrefix(unitName, "couchbase_node@") || !strings.HasSuffix(unitName, ".service") {
+		return -1, false
+	}
+
+	numberStr := strings.TrimSuffix(strings.TrimPrefix(unitName, "couchbase_node@"), ".service")
+	unitNumber, err := strconv.Atoi(numberStr)
+	if err != nil {
+		return -1, false
+	}
+
+	return unitNumber, true
+
+}
+
+func couchbaseUnitName(unitNumber int) string {
+	return fmt.Sprintf("couchbase_node@%v.service", unitNumber)
+}
+
+// Get the unit json of an existing unit, so that it can be used for new units
+func (c CouchbaseFleet) getFleetUnitJson(unitName string) (string, error) {
+
+	fleetUnit, err := c.fleetClient.Unit(unitName)
+	if err != nil {
+		return "", err
+	}
+	if fleetUnit == nil {
+		return "", fmt.Errorf("No such unit: %v", unitName)
+	}
+
+	newUnit := FleetUnit{
+		DesiredState: "launched",
+		Options:      fleetUnit.Options,
+	}
+
+	fleetUnitJson, err := json.Marshal(newUnit)
+	if err != nil {
+		return "", err
+	}
+
+	return string(fleetUnitJson), nil
+
+}
+
+// Find the primary ip of the machine each unit was scheduled on, keyed by unit name
+func (c CouchbaseFleet) fleetUnitMachineIps() (map[string]string, error) {
+
+	machines, err := c.fleetClient.Machines()
+	if err != nil {
+		return nil, err
+	}
+
+	machineIps := map[string]string{}
+	for _, machine := range machines {
+		machineIps[machine.ID] = machine.PrimaryIP
+	}
+
+	states, err := c.fleetClient.UnitStates()
+	if err != nil {
+		return nil, err
+	}
+
+	unitIps := map[string]string{}
+	for _, state := range states {
+		if ip, ok := machineIps[state.MachineID]; ok {
+			unitIps[state.Name] = ip
+		}
+	}
+
+	return unitIps, nil
 
 }
@@ -0,0 +1,274 @@
+package cbcluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	FLEET_API_PATH        = "/v1-alpha"
+	DEFAULT_FLEET_TIMEOUT = time.Second * 30
+)
+
+// A client for the fleet REST api.  See
+// https://github.com/coreos/fleet/blob/master/Documentation/api-v1.md
+type FleetClient struct {
+	endpoint   string // ie, http://localhost:49153/v1-alpha
+	httpClient *http.Client
+}
+
+type FleetMachine struct {
+	ID        string            `json:"id"`
+	PrimaryIP string            `json:"primaryIP"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+type FleetUnit struct {
+	Name         string            `json:"name,omitempty"`
+	DesiredState string            `json:"desiredState"`
+	CurrentState string            `json:"currentState,omitempty"`
+	MachineID    string            `json:"machineID,omitempty"`
+	Options      []FleetUnitOption `json:"options"`
+}
+
+type FleetUnitOption struct {
+	Section string `json:"section"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+}
+
+// The state of a unit as reported by /state, ie:
+// {"name":"couchbase_node@1.service","machineID":"a91c..","systemdActiveState":"active", ..}
+type FleetUnitState struct {
+	Name               string `json:"name"`
+	Hash               string `json:"hash"`
+	MachineID          string `json:"machineID"`
+	SystemdLoadState   string `json:"systemdLoadState"`
+	SystemdActiveState string `json:"systemdActiveState"`
+	SystemdSubState    string `json:"systemdSubState"`
+}
+
+// Create a fleet client.  The endpoint is either an http url including the
+// api path (ie, http://localhost:49153/v1-alpha), or the fleet unix socket
+// (ie, unix:///var/run/fleet.sock).
+func NewFleetClient(endpoint string, timeout time.Duration) (*FleetClient, error) {
+
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+
+	switch endpointUrl.Scheme {
+	case "http", "https":
+	case "unix":
+		socketPath := endpointUrl.Path
+		httpClient.Transport = &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.DialTimeout("unix", socketPath, timeout)
+			},
+		}
+		// the host is ignored when dialing the socket
+		endpoint = "http://fleet" + FLEET_API_PATH
+	default:
+		return nil, fmt.Errorf("Unsupported fleet endpoint: %v", endpoint)
+	}
+
+	return &FleetClient{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		httpClient: httpClient,
+	}, nil
+
+}
+
+func (f FleetClient) Machines() ([]FleetMachine, error) {
+
+	machines := []FleetMachine{}
+
+	err := f.getPages("/machines", func(page io.Reader) (string, error) {
+		pageJson := struct {
+			Machines      []FleetMachine `json:"machines"`
+			NextPageToken string         `json:"nextPageToken"`
+		}{}
+		if err := json.NewDecoder(page).Decode(&pageJson); err != nil {
+			return "", err
+		}
+		machines = append(machines, pageJson.Machines...)
+		return pageJson.NextPageToken, nil
+	})
+
+	return machines, err
+
+}
+
+func (f FleetClient) Units() ([]FleetUnit, error) {
+
+	units := []FleetUnit{}
+
+	err := f.getPages("/units", func(page io.Reader) (string, error) {
+		pageJson := struct {
+			Units         []FleetUnit `json:"units"`
+			NextPageToken string      `json:"nextPageToken"`
+		}{}
+		if err := json.NewDecoder(page).Decode(&pageJson); err != nil {
+			return "", err
+		}
+		units = append(units, pageJson.Units...)
+		return pageJson.NextPageToken, nil
+	})
+
+	return units, err
+
+}
+
+// Get a single unit, or nil if there is no such unit
+func (f FleetClient) Unit(name string) (*FleetUnit, error) {
+
+	resp, err := f.do("GET", fmt.Sprintf("/units/%v", name), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := checkFleetResponse(resp); err != nil {
+		return nil, err
+	}
+
+	unit := &FleetUnit{}
+	if err := json.NewDecoder(resp.Body).Decode(unit); err != nil {
+		return nil, err
+	}
+
+	return unit, nil
+
+}
+
+func (f FleetClient) UnitStates() ([]FleetUnitState, error) {
+
+	states := []FleetUnitState{}
+
+	err := f.getPages("/state", func(page io.Reader) (string, error) {
+		pageJson := struct {
+			States        []FleetUnitState `json:"states"`
+			NextPageToken string           `json:"nextPageToken"`
+		}{}
+		if err := json.NewDecoder(page).Decode(&pageJson); err != nil {
+			return "", err
+		}
+		states = append(states, pageJson.States...)
+		return pageJson.NextPageToken, nil
+	})
+
+	return states, err
+
+}
+
+// Create the unit, or change its desired state if it already exists
+func (f FleetClient) CreateUnit(name string, unit FleetUnit) error {
+
+	unitJson, err := json.Marshal(unit)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.do("PUT", fmt.Sprintf("/units/%v", name), unitJson)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkFleetResponse(resp)
+
+}
+
+func (f FleetClient) DestroyUnit(name string) error {
+
+	resp, err := f.do("DELETE", fmt.Sprintf("/units/%v", name), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkFleetResponse(resp)
+
+}
+
+// GET a paginated collection, calling handlePage with each page until
+// it returns an empty nextPageToken.
+func (f FleetClient) getPages(collectionPath string, handlePage func(page io.Reader) (string, error)) error {
+
+	nextPageToken := ""
+
+	for {
+
+		pagePath := collectionPath
+		if nextPageToken != "" {
+			pagePath = fmt.Sprintf("%v?nextPageToken=%v", collectionPath, url.QueryEscape(nextPageToken))
+		}
+
+		resp, err := f.do("GET", pagePath, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := checkFleetResponse(resp); err != nil {
+			resp.Body.Close()
+			return err
+		}
+
+		nextPageToken, err = handlePage(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if nextPageToken == "" {
+			return nil
+		}
+
+	}
+
+}
+
+func (f FleetClient) do(method, relativePath string, body []byte) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, f.endpoint+relativePath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return f.httpClient.Do(req)
+
+}
+
+func checkFleetResponse(resp *http.Response) error {
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf(
+		"Fleet %v %v failed.  Status code: %v.  Body: %v",
+		resp.Request.Method,
+		resp.Request.URL,
+		resp.StatusCode,
+		string(body),
+	)
+
+}
@@ -0,0 +1,153 @@
+package cbcluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFleetClientFollowsNextPageToken(t *testing.T) {
+
+	pages := map[string]string{
+		"":       `{"machines":[{"id":"m1","primaryIP":"10.0.0.1"}],"nextPageToken":"page 2"}`,
+		"page 2": `{"machines":[{"id":"m2","primaryIP":"10.0.0.2"}],"nextPageToken":"page3"}`,
+		"page3":  `{"machines":[{"id":"m3","primaryIP":"10.0.0.3"}]}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != FLEET_API_PATH+"/machines" {
+			http.NotFound(w, r)
+			return
+		}
+		page, ok := pages[r.URL.Query().Get("nextPageToken")]
+		if !ok {
+			http.Error(w, "unknown page token", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+	defer server.Close()
+
+	fleetClient, err := NewFleetClient(server.URL+FLEET_API_PATH, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machines, err := fleetClient.Machines()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := []string{}
+	for _, machine := range machines {
+		ips = append(ips, machine.PrimaryIP)
+	}
+	if strings.Join(ips, ",") != "10.0.0.1,10.0.0.2,10.0.0.3" {
+		t.Fatalf("Expected the machines of all three pages, got: %v", ips)
+	}
+
+}
+
+func TestFleetClientPageError(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("nextPageToken") == "" {
+			fmt.Fprint(w, `{"units":[{"name":"a.service","desiredState":"launched","options":[]}],"nextPageToken":"next"}`)
+			return
+		}
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	fleetClient, err := NewFleetClient(server.URL+FLEET_API_PATH, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fleetClient.Units(); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("Expected the error of the second page, got: %v", err)
+	}
+
+}
+
+func TestFleetClientUnixEndpoint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fleet_client_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "fleet.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(FLEET_API_PATH+"/units/couchbase_node@1.service", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"name":"couchbase_node@1.service","desiredState":"launched","options":[{"section":"Service","name":"ExecStart","value":"/bin/true"}]}`)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer listener.Close()
+
+	fleetClient, err := NewFleetClient("unix://"+socketPath, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit, err := fleetClient.Unit("couchbase_node@1.service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unit == nil || len(unit.Options) != 1 || unit.Options[0].Value != "/bin/true" {
+		t.Fatalf("Unexpected unit: %+v", unit)
+	}
+
+	missing, err := fleetClient.Unit("couchbase_node@2.service")
+	if err != nil || missing != nil {
+		t.Fatalf("Expected no unit and no error for a missing unit, got: %+v, %v", missing, err)
+	}
+
+}
+
+func TestFleetClientUnsupportedEndpoint(t *testing.T) {
+
+	if _, err := NewFleetClient("ftp://localhost/v1-alpha", time.Second); err == nil {
+		t.Fatalf("Expected an error for an ftp endpoint")
+	}
+
+}
+
+func TestFleetClientTimeout(t *testing.T) {
+
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	fleetClient, err := NewFleetClient(server.URL+FLEET_API_PATH, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = fleetClient.UnitStates()
+	if err == nil {
+		t.Fatalf("Expected the request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Request gave up after %v, expected it to time out after 50ms", elapsed)
+	}
+
+}
@@ -0,0 +1,100 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSystemdUnitToFleetJson(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		unit     string
+		expected []FleetUnitOption
+	}{
+		{
+			name: "sections, comments and blank lines",
+			unit: `
+# a comment
+[Unit]
+Description=Couchbase node
+
+; another comment
+[Service]
+ExecStartPre=-/usr/bin/docker kill couchbase
+ExecStart=/usr/bin/docker run --name couchbase couchbase
+
+[X-Fleet]
+Conflicts=couchbase_node*.service
+`,
+			expected: []FleetUnitOption{
+				{Section: "Unit", Name: "Description", Value: "Couchbase node"},
+				{Section: "Service", Name: "ExecStartPre", Value: "-/usr/bin/docker kill couchbase"},
+				{Section: "Service", Name: "ExecStart", Value: "/usr/bin/docker run --name couchbase couchbase"},
+				{Section: "X-Fleet", Name: "Conflicts", Value: "couchbase_node*.service"},
+			},
+		},
+		{
+			name: "only the first = splits name and value",
+			unit: "[Service]\nEnvironment=OPTS=a=b\nExecStart = /bin/sh -c 'x=1 y'\n",
+			expected: []FleetUnitOption{
+				{Section: "Service", Name: "Environment", Value: "OPTS=a=b"},
+				{Section: "Service", Name: "ExecStart", Value: "/bin/sh -c 'x=1 y'"},
+			},
+		},
+		{
+			name: "continued lines",
+			unit: "[Service]\nExecStart=/usr/bin/docker run \\\n  --net=host \\\n  couchbase\nExecStop=/usr/bin/docker stop couchbase\n",
+			expected: []FleetUnitOption{
+				{Section: "Service", Name: "ExecStart", Value: "/usr/bin/docker run --net=host couchbase"},
+				{Section: "Service", Name: "ExecStop", Value: "/usr/bin/docker stop couchbase"},
+			},
+		},
+		{
+			name: "repeated options keep their order",
+			unit: "[X-Fleet]\nMachineMetadata=role=couchbase\nMachineMetadata=disk=ssd\n",
+			expected: []FleetUnitOption{
+				{Section: "X-Fleet", Name: "MachineMetadata", Value: "role=couchbase"},
+				{Section: "X-Fleet", Name: "MachineMetadata", Value: "disk=ssd"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		fleetUnitJson, err := systemdUnitToFleetJson(test.unit)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		fleetUnit := FleetUnit{}
+		if err := json.Unmarshal([]byte(fleetUnitJson), &fleetUnit); err != nil {
+			t.Fatal(err)
+		}
+		if fleetUnit.DesiredState != "launched" {
+			t.Errorf("%v: expected desiredState launched, got %q", test.name, fleetUnit.DesiredState)
+		}
+		if !reflect.DeepEqual(fleetUnit.Options, test.expected) {
+			t.Errorf("%v: expected options %+v, got %+v", test.name, test.expected, fleetUnit.Options)
+		}
+
+	}
+
+}
+
+func TestSystemdUnitToFleetJsonInvalid(t *testing.T) {
+
+	invalidUnits := map[string]string{
+		"outside of any section": "ExecStart=/bin/true\n[Service]\n",
+		"not name=value":         "[Service]\nExecStart /bin/true\n",
+	}
+
+	for name, unit := range invalidUnits {
+		if _, err := systemdUnitToFleetJson(unit); err == nil {
+			t.Errorf("Expected a line %v to be rejected", name)
+		}
+	}
+
+}
@@ -0,0 +1,190 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The body of /healthz and /readyz.  Each check that ran is listed, and
+// Ok is only true if all of them passed.
+type HealthReport struct {
+	Ok             bool          `json:"ok"`
+	LifecycleState string        `json:"lifecycleState"`
+	Checks         []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (report *HealthReport) check(name string, err error) bool {
+
+	healthCheck := HealthCheck{Name: name, Ok: err == nil}
+	if err != nil {
+		healthCheck.Error = err.Error()
+		report.Ok = false
+	}
+	report.Checks = append(report.Checks, healthCheck)
+	return err == nil
+
+}
+
+// Start the http listeners of the node daemon in the background: the
+// metrics on c.MetricsAddr and /healthz and /readyz on c.HealthAddr.  When
+// both addresses are the same, a single listener serves all of them.  The
+// addresses are bound before returning, so that a port already in use is
+// an error rather than a log line.
+func (c CouchbaseCluster) startAgentListeners() error {
+
+	muxes := map[string]*http.ServeMux{}
+	muxFor := func(addr string) *http.ServeMux {
+		if _, ok := muxes[addr]; !ok {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if c.MetricsAddr != "" {
+		muxFor(c.MetricsAddr).HandleFunc("/metrics", c.handleMetrics)
+	}
+	if c.HealthAddr != "" {
+		muxFor(c.HealthAddr).HandleFunc("/healthz", c.handleHealthz)
+		muxFor(c.HealthAddr).HandleFunc("/readyz", c.handleReadyz)
+	}
+
+	listeners := map[string]net.Listener{}
+	for addr := range muxes {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, bound := range listeners {
+				bound.Close()
+			}
+			return fmt.Errorf("Unable to listen on %v: %v", addr, err)
+		}
+		listeners[addr] = listener
+	}
+
+	for addr, listener := range listeners {
+		c.logger().Infof("Serving node daemon endpoints on: %v", addr)
+		go func(addr string, listener net.Listener, mux *http.ServeMux) {
+			if err := http.Serve(listener, mux); err != nil {
+				c.logger().Warnf("Listener on %v failed: %v", addr, err)
+			}
+		}(addr, listener, muxes[addr])
+	}
+
+	return nil
+
+}
+
+// The handlers run on the copy of c taken when the listeners started, so
+// reload the admin credentials in case they were rotated since then.
+func (c *CouchbaseCluster) reloadCredsForHandler(handlerName string) {
+
+	if _, err := c.ReloadAdminCredsEtcd(); err != nil {
+		c.logger().Warnf("%v: failed to reload admin credentials: %v", handlerName, err)
+	}
+
+}
+
+// The daemon is alive (since it answers) and etcd is reachable
+func (c CouchbaseCluster) handleHealthz(w http.ResponseWriter, r *http.Request) {
+
+	report := &HealthReport{Ok: true, LifecycleState: c.metrics.LifecycleState()}
+
+	report.check("etcd", c.checkEtcdReachable())
+
+	writeHealthReport(w, report)
+
+}
+
+// The node has finished joining, local couchbase is running, the node is a
+// healthy active member of the cluster, and no rebalance is pending
+func (c CouchbaseCluster) handleReadyz(w http.ResponseWriter, r *http.Request) {
+
+	report := &HealthReport{Ok: true, LifecycleState: c.metrics.LifecycleState()}
+
+	var joinedErr error
+	if report.LifecycleState != NODE_LIFECYCLE_RUNNING {
+		joinedErr = fmt.Errorf("Node daemon is %v, not %v yet", report.LifecycleState, NODE_LIFECYCLE_RUNNING)
+	}
+	if !report.check("joined", joinedErr) {
+		writeHealthReport(w, report)
+		return
+	}
+
+	c.reloadCredsForHandler("Readyz")
+
+	poolNodes, err := c.GetPoolNodes(c.LocalCouchbaseIp)
+	if !report.check("couchbase-running", err) {
+		writeHealthReport(w, report)
+		return
+	}
+
+	report.check("cluster-member", c.checkActiveHealthyMember(poolNodes))
+
+	rebalanceStatus, err := c.rebalanceStatus(c.LocalCouchbaseIp)
+	if err == nil && rebalanceStatus != "none" {
+		err = fmt.Errorf("Rebalance status is %v", rebalanceStatus)
+	}
+	report.check("no-rebalance", err)
+
+	writeHealthReport(w, report)
+
+}
+
+func (c CouchbaseCluster) checkEtcdReachable() error {
+
+	_, err := c.etcdClient.Get(KEY_NODE_STATE, false, false)
+	if err != nil && !strings.Contains(err.Error(), "Key not found") {
+		return err
+	}
+	return nil
+
+}
+
+// Is this node listed as healthy and active?  A node that was added but
+// not rebalanced in yet shows up with clusterMembership inactiveAdded.
+func (c CouchbaseCluster) checkActiveHealthyMember(poolNodes []PoolNode) error {
+
+	for _, poolNode := range poolNodes {
+
+		// we asked the local node, so it flags itself with thisNode
+		nodeIp, _, _ := net.SplitHostPort(poolNode.Hostname)
+		if !poolNode.ThisNode && nodeIp != c.LocalCouchbaseIp {
+			continue
+		}
+
+		if poolNode.Status != "healthy" {
+			return fmt.Errorf("Node status is %v", poolNode.Status)
+		}
+		if poolNode.ClusterMembership != "active" {
+			return fmt.Errorf("Node cluster membership is %v, a rebalance is pending", poolNode.ClusterMembership)
+		}
+		return nil
+
+	}
+
+	return fmt.Errorf("Node %v is not in the cluster", c.LocalCouchbaseIp)
+
+}
+
+func writeHealthReport(w http.ResponseWriter, report *HealthReport) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		defaultLogger.Warnf("Failed to write health report: %v", err)
+	}
+
+}
@@ -39,3 +39,35 @@ func getJsonDataMiddleware(endpointUrl string, into interface{}, middleware midd
 func getJsonData(endpointUrl string, into interface{}) error {
 	return getJsonDataMiddleware(endpointUrl, into, func(req *http.Request) {})
 }
+
+// Like getJsonDataMiddleware, but a 404 is not treated as an error.  Instead
+// the status code is returned and into is left untouched.
+func getJsonDataStatusMiddleware(endpointUrl string, into interface{}, middleware middlewareFunc) (int, error) {
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("GET", endpointUrl, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	middleware(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Failed to GET %v.  Status code: %v", endpointUrl, resp.StatusCode)
+	}
+
+	d := json.NewDecoder(resp.Body)
+	return resp.StatusCode, d.Decode(into)
+
+}
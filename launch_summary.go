@@ -0,0 +1,126 @@
+package cbcluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// What was launched, as reported by the live cluster.  Printed when
+// launch-cbs finishes so that provisioning scripts can consume it.
+type LaunchSummary struct {
+	Version string              `json:"version"` // couchbase version reported by the cluster
+	Nodes   []LaunchSummaryNode `json:"nodes"`
+	Buckets []string            `json:"buckets"`
+}
+
+type LaunchSummaryNode struct {
+	Ip         string `json:"ip"`
+	Port       string `json:"port"`
+	OtpNode    string `json:"otpNode"`
+	Version    string `json:"version"`
+	ConsoleUrl string `json:"consoleUrl"`
+}
+
+// Fetch the node and bucket details from the live cluster
+func (c CouchbaseFleet) LaunchSummary() (*LaunchSummary, error) {
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(c.EtcdServers)
+	if err != nil {
+		return nil, err
+	}
+
+	poolNodes, err := couchbaseCluster.GetPoolNodes(liveNodeIp)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketNames, err := couchbaseCluster.GetBucketNames(liveNodeIp)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &LaunchSummary{
+		Nodes:   []LaunchSummaryNode{},
+		Buckets: bucketNames,
+	}
+	if len(poolNodes) > 0 {
+		summary.Version = poolNodes[0].Version
+	}
+
+	for _, poolNode := range poolNodes {
+
+		ip, port, err := net.SplitHostPort(poolNode.Hostname)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected hostname %v: %v", poolNode.Hostname, err)
+		}
+
+		summary.Nodes = append(summary.Nodes, LaunchSummaryNode{
+			Ip:         ip,
+			Port:       port,
+			OtpNode:    poolNode.OtpNode,
+			Version:    poolNode.Version,
+			ConsoleUrl: fmt.Sprintf("http://%v:%v/", ip, port),
+		})
+
+	}
+
+	return summary, nil
+
+}
+
+// Write the summary in the given format (text or json)
+func (summary LaunchSummary) Write(w io.Writer, format string) error {
+
+	if err := validateOutputFormat(format); err != nil {
+		return err
+	}
+	if format == OUTPUT_FORMAT_JSON {
+		return writeJson(w, summary, true)
+	}
+
+	fmt.Fprintf(w, "Version: %v\n", summary.Version)
+	fmt.Fprintf(w, "Buckets: %v\n", summary.Buckets)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "IP\tPORT\tOTP NODE\tCONSOLE\n")
+	for _, node := range summary.Nodes {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", node.Ip, node.Port, node.OtpNode, node.ConsoleUrl)
+	}
+	return tw.Flush()
+
+}
+
+// Print the launch summary to stdout, or write it to c.OutputFile if set
+func (c CouchbaseFleet) reportLaunchSummary() error {
+
+	summary, err := c.LaunchSummary()
+	if err != nil {
+		return err
+	}
+
+	if c.OutputFile == "" {
+		return summary.Write(os.Stdout, c.OutputFormat)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.OutputFile), ".launch-summary")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := summary.Write(f, c.OutputFormat); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// scripts watching the file never see it half written
+	return os.Rename(f.Name(), c.OutputFile)
+
+}
@@ -0,0 +1,126 @@
+package cbcluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// Just enough of the memcached binary protocol to authenticate against a
+// bucket and store documents on the data port.
+// See https://code.google.com/p/memcached/wiki/BinaryProtocolRevamped
+
+const (
+	MEMCACHED_REQ_MAGIC    = 0x80
+	MEMCACHED_RES_MAGIC    = 0x81
+	MEMCACHED_OP_SET       = 0x01
+	MEMCACHED_OP_SASL_AUTH = 0x21
+	MEMCACHED_HEADER_LEN   = 24
+	MEMCACHED_TIMEOUT      = time.Second * 30
+
+	MEMCACHED_STATUS_NOT_MY_VBUCKET = 0x07
+)
+
+type memcachedConn struct {
+	conn net.Conn
+}
+
+// A non-zero response status.  The connection is still usable after one,
+// unlike after any other error from do.
+type memcachedStatusError struct {
+	status uint16
+	body   string
+}
+
+func (e memcachedStatusError) Error() string {
+	return fmt.Sprintf("Memcached error status: 0x%x: %v", e.status, e.body)
+}
+
+// Connect to the data port at addr (ie, "10.0.0.1:11210") and authenticate
+// against bucket using SASL PLAIN.
+func dialMemcached(addr, bucket, password string) (*memcachedConn, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, MEMCACHED_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &memcachedConn{conn: conn}
+
+	credentials := fmt.Sprintf("\x00%v\x00%v", bucket, password)
+	if err := mc.do(MEMCACHED_OP_SASL_AUTH, 0, nil, []byte("PLAIN"), []byte(credentials)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to authenticate against bucket %v: %v", bucket, err)
+	}
+
+	return mc, nil
+
+}
+
+// Store value under key in the given vbucket, with no flags or expiry.
+func (mc *memcachedConn) set(vbucket uint16, key string, value []byte) error {
+
+	extras := make([]byte, 8)
+	return mc.do(MEMCACHED_OP_SET, vbucket, extras, []byte(key), value)
+
+}
+
+func (mc *memcachedConn) close() error {
+	return mc.conn.Close()
+}
+
+// Send a single request and wait for its response, returning an error
+// for any non-zero response status.
+func (mc *memcachedConn) do(opcode byte, vbucket uint16, extras, key, value []byte) error {
+
+	bodyLen := len(extras) + len(key) + len(value)
+
+	packet := make([]byte, MEMCACHED_HEADER_LEN+bodyLen)
+	packet[0] = MEMCACHED_REQ_MAGIC
+	packet[1] = opcode
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(key)))
+	packet[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(packet[6:8], vbucket)
+	binary.BigEndian.PutUint32(packet[8:12], uint32(bodyLen))
+	copy(packet[MEMCACHED_HEADER_LEN:], extras)
+	copy(packet[MEMCACHED_HEADER_LEN+len(extras):], key)
+	copy(packet[MEMCACHED_HEADER_LEN+len(extras)+len(key):], value)
+
+	mc.conn.SetDeadline(time.Now().Add(MEMCACHED_TIMEOUT))
+
+	if _, err := mc.conn.Write(packet); err != nil {
+		return err
+	}
+
+	header := make([]byte, MEMCACHED_HEADER_LEN)
+	if _, err := io.ReadFull(mc.conn, header); err != nil {
+		return err
+	}
+	if header[0] != MEMCACHED_RES_MAGIC {
+		return fmt.Errorf("Unexpected magic in response: %x", header[0])
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(mc.conn, body); err != nil {
+		return err
+	}
+
+	status := binary.BigEndian.Uint16(header[6:8])
+	if status != 0 {
+		return memcachedStatusError{status: status, body: string(body)}
+	}
+
+	return nil
+
+}
+
+// Which vbucket a key belongs to, using the CRC hashing couchbase uses.
+func vbucketForKey(key string, numVbuckets int) uint16 {
+
+	crc := crc32.ChecksumIEEE([]byte(key))
+	return uint16(((crc >> 16) & 0x7fff) & uint32(numVbuckets-1))
+
+}
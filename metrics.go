@@ -0,0 +1,246 @@
+package cbcluster
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NODE_LIFECYCLE_STARTING     = "starting"
+	NODE_LIFECYCLE_INITIALIZING = "initializing" // first node, initializing the cluster
+	NODE_LIFECYCLE_JOINING      = "joining"
+	NODE_LIFECYCLE_RUNNING      = "running"
+)
+
+var NODE_LIFECYCLE_STATES = []string{
+	NODE_LIFECYCLE_STARTING,
+	NODE_LIFECYCLE_INITIALIZING,
+	NODE_LIFECYCLE_JOINING,
+	NODE_LIFECYCLE_RUNNING,
+}
+
+// What the node daemon records about itself.  The rebalance status and
+// bucket stats are fetched from couchbase on each scrape instead.  Methods
+// are safe to call on a nil *NodeMetrics, which records nothing.
+type NodeMetrics struct {
+	mutex              sync.Mutex
+	heartbeatSuccesses int64
+	heartbeatFailures  int64
+	etcdLatencySum     float64 // seconds
+	etcdLatencyCount   int64
+	etcdLatencyLast    float64
+	lifecycleState     string
+}
+
+func NewNodeMetrics() *NodeMetrics {
+	return &NodeMetrics{lifecycleState: NODE_LIFECYCLE_STARTING}
+}
+
+func (m *NodeMetrics) recordHeartbeat(err error) {
+
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		m.heartbeatFailures += 1
+	} else {
+		m.heartbeatSuccesses += 1
+	}
+
+}
+
+func (m *NodeMetrics) recordEtcdLatency(latency time.Duration) {
+
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.etcdLatencyLast = latency.Seconds()
+	m.etcdLatencySum += latency.Seconds()
+	m.etcdLatencyCount += 1
+
+}
+
+func (m *NodeMetrics) setLifecycleState(state string) {
+
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lifecycleState = state
+
+}
+
+// Record the lifecycle state, and add it as the phase field of the log lines
+func (c *CouchbaseCluster) setLifecycleState(state string) {
+	c.metrics.setLifecycleState(state)
+	c.Logger = c.logger().With("phase", state)
+}
+
+func (m *NodeMetrics) LifecycleState() string {
+
+	if m == nil {
+		return ""
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.lifecycleState
+
+}
+
+// Write the metrics in the prometheus text format.  See
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func (c CouchbaseCluster) handleMetrics(w http.ResponseWriter, r *http.Request) {
+
+	out := &bytes.Buffer{}
+
+	c.writeNodeMetrics(out)
+
+	c.reloadCredsForHandler("Metrics")
+
+	rebalanceStatus, err := c.rebalanceStatus(c.LocalCouchbaseIp)
+	writeMetricHeader(out, "couchbase_rebalance_running", "gauge", "1 if a rebalance is running, -1 if the rebalance status is unavailable")
+	switch {
+	case err != nil:
+		c.logger().Warnf("Metrics: failed to get rebalance status: %v", err)
+		fmt.Fprintf(out, "couchbase_rebalance_running -1\n")
+	case rebalanceStatus == "none":
+		fmt.Fprintf(out, "couchbase_rebalance_running 0\n")
+	default:
+		fmt.Fprintf(out, "couchbase_rebalance_running 1\n")
+	}
+
+	c.writeBucketMetrics(out)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+
+}
+
+func (c CouchbaseCluster) writeNodeMetrics(out *bytes.Buffer) {
+
+	m := c.metrics
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeMetricHeader(out, "couchbase_node_heartbeats_total", "counter", "Heartbeats published to etcd by the node daemon")
+	fmt.Fprintf(out, "couchbase_node_heartbeats_total{result=\"success\"} %v\n", m.heartbeatSuccesses)
+	fmt.Fprintf(out, "couchbase_node_heartbeats_total{result=\"failure\"} %v\n", m.heartbeatFailures)
+
+	writeMetricHeader(out, "couchbase_node_etcd_request_duration_seconds", "summary", "Time taken to publish the heartbeat to etcd")
+	fmt.Fprintf(out, "couchbase_node_etcd_request_duration_seconds_sum %v\n", m.etcdLatencySum)
+	fmt.Fprintf(out, "couchbase_node_etcd_request_duration_seconds_count %v\n", m.etcdLatencyCount)
+
+	writeMetricHeader(out, "couchbase_node_etcd_last_request_duration_seconds", "gauge", "Time taken by the most recent heartbeat")
+	fmt.Fprintf(out, "couchbase_node_etcd_last_request_duration_seconds %v\n", m.etcdLatencyLast)
+
+	writeMetricHeader(out, "couchbase_node_lifecycle_state", "gauge", "1 for the state the node daemon is in, 0 for the others")
+	for _, state := range NODE_LIFECYCLE_STATES {
+		value := 0
+		if state == m.lifecycleState {
+			value = 1
+		}
+		fmt.Fprintf(out, "couchbase_node_lifecycle_state{state=%q} %v\n", state, value)
+	}
+
+}
+
+// Write the latest sample of each stat of each bucket
+func (c CouchbaseCluster) writeBucketMetrics(out *bytes.Buffer) {
+
+	bucketNames, err := c.GetBucketNames(c.LocalCouchbaseIp)
+	if err != nil {
+		c.logger().Warnf("Metrics: failed to get buckets: %v", err)
+		return
+	}
+
+	writeMetricHeader(out, "couchbase_bucket_stat", "gauge", "Latest sample of each stat in /pools/default/buckets/<bucket>/stats")
+
+	for _, bucketName := range bucketNames {
+
+		stats, err := c.latestBucketStats(bucketName)
+		if err != nil {
+			c.logger().Warnf("Metrics: failed to get stats of bucket %v: %v", bucketName, err)
+			continue
+		}
+
+		statNames := []string{}
+		for statName := range stats {
+			statNames = append(statNames, statName)
+		}
+		sort.Strings(statNames)
+
+		for _, statName := range statNames {
+			fmt.Fprintf(
+				out,
+				"couchbase_bucket_stat{bucket=\"%v\",stat=\"%v\"} %v\n",
+				escapeLabelValue(bucketName),
+				escapeLabelValue(statName),
+				stats[statName],
+			)
+		}
+
+	}
+
+}
+
+// Get the most recent sample of each bucket stat
+func (c CouchbaseCluster) latestBucketStats(bucketName string) (map[string]float64, error) {
+
+	endpointUrl := fmt.Sprintf(
+		"http://%v:%v/pools/default/buckets/%v/stats",
+		c.LocalCouchbaseIp,
+		c.LocalCouchbasePort,
+		bucketName,
+	)
+
+	// ie, {"op":{"samples":{"ops":[0,0,1.5], "curr_items":[10,10,12], ..}}}
+	bucketStats := struct {
+		Op struct {
+			Samples map[string][]interface{} `json:"samples"`
+		} `json:"op"`
+	}{}
+	if err := c.getJsonData(endpointUrl, &bucketStats); err != nil {
+		return nil, err
+	}
+
+	latest := map[string]float64{}
+	for statName, samples := range bucketStats.Op.Samples {
+		if len(samples) == 0 {
+			continue
+		}
+		if sample, ok := samples[len(samples)-1].(float64); ok {
+			latest[statName] = sample
+		}
+	}
+
+	return latest, nil
+
+}
+
+func writeMetricHeader(out *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(out, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(out, "# TYPE %v %v\n", name, metricType)
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
@@ -0,0 +1,44 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	OUTPUT_FORMAT_TEXT = "text"
+	OUTPUT_FORMAT_JSON = "json"
+)
+
+// Check that format is one of the report formats.  An empty format is text.
+func validateOutputFormat(format string) error {
+
+	switch format {
+	case OUTPUT_FORMAT_TEXT, OUTPUT_FORMAT_JSON, "":
+		return nil
+	default:
+		return fmt.Errorf("Unknown output format: %v.  Use text or json", format)
+	}
+
+}
+
+// Write value as json followed by a newline.  Reports are indented, while
+// streamed entries such as events stay on one line each.
+func writeJson(w io.Writer, value interface{}, indent bool) error {
+
+	var valueJson []byte
+	var err error
+	if indent {
+		valueJson, err = json.MarshalIndent(value, "", "  ")
+	} else {
+		valueJson, err = json.Marshal(value)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", valueJson)
+	return err
+
+}
@@ -0,0 +1,249 @@
+package cbcluster
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+const (
+	KEY_BUCKET_REPLICAS = "/couchbase.com/bucket-replicas"
+	MAX_REPLICA_NUMBER  = 3
+)
+
+// Change the replica number of bucket, connecting to liveNodeIp, and
+// rebalance the cluster so that the change takes effect.  Each replica
+// needs its own node, so the cluster must have at least replicaNumber + 1
+// healthy nodes.
+func (c CouchbaseCluster) SetBucketReplicaNumber(liveNodeIp, bucket string, replicaNumber int) error {
+
+	c.logger().Infof("SetBucketReplicaNumber() called with: %v, %v", bucket, replicaNumber)
+
+	if replicaNumber < 0 || replicaNumber > MAX_REPLICA_NUMBER {
+		return fmt.Errorf("Replica number must be between 0 and %v, got %v", MAX_REPLICA_NUMBER, replicaNumber)
+	}
+
+	enoughNodes, err := c.CheckNumNodesClusterHealthy(replicaNumber+1, liveNodeIp)
+	if err != nil {
+		return err
+	}
+	if !enoughNodes {
+		return fmt.Errorf("Need at least %v healthy nodes for %v replicas", replicaNumber+1, replicaNumber)
+	}
+
+	bucketMap, err := c.GetBucket(liveNodeIp, bucket)
+	if err != nil {
+		return err
+	}
+
+	currentReplicaNumber, ok := bucketMap["replicaNumber"].(float64)
+	if !ok {
+		return fmt.Errorf("No replicaNumber found for bucket %v", bucket)
+	}
+	if int(currentReplicaNumber) == replicaNumber {
+		c.logger().Infof("Bucket %v already has %v replicas, nothing to do", bucket, replicaNumber)
+		return nil
+	}
+
+	// the bucket edit endpoint insists on getting the ram quota and
+	// auth type along with the replica number, so pass the current ones.
+	quota, ok := bucketMap["quota"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("No quota found for bucket %v", bucket)
+	}
+	rawRam, ok := quota["rawRAM"].(float64)
+	if !ok {
+		return fmt.Errorf("No rawRAM quota found for bucket %v", bucket)
+	}
+	authType, ok := bucketMap["authType"].(string)
+	if !ok {
+		return fmt.Errorf("No authType found for bucket %v", bucket)
+	}
+
+	endpointUrl := fmt.Sprintf(
+		"http://%v:%v/pools/default/buckets/%v",
+		liveNodeIp,
+		c.LocalCouchbasePort,
+		bucket,
+	)
+
+	data := url.Values{
+		"ramQuotaMB":    {strconv.Itoa(int(rawRam) / 1024 / 1024)},
+		"authType":      {authType},
+		"replicaNumber": {strconv.Itoa(replicaNumber)},
+	}
+
+	c.logger().Infof("Changing replica number of bucket %v from %v to %v", bucket, currentReplicaNumber, replicaNumber)
+	if err := c.POST(false, endpointUrl, data); err != nil {
+		return err
+	}
+
+	// the new replica number only takes effect after a rebalance
+	if err := c.WaitUntilNoRebalanceRunning(liveNodeIp); err != nil {
+		return err
+	}
+
+	if err := c.TriggerRebalance(liveNodeIp); err != nil {
+		return err
+	}
+
+	return c.WaitUntilRebalanceFinished(liveNodeIp)
+
+}
+
+// Get the bucket details from /pools/default/buckets/<bucket>
+func (c CouchbaseCluster) GetBucket(liveNodeIp, bucket string) (map[string]interface{}, error) {
+
+	endpointUrl := fmt.Sprintf(
+		"http://%v:%v/pools/default/buckets/%v",
+		liveNodeIp,
+		c.LocalCouchbasePort,
+		bucket,
+	)
+
+	jsonMap := map[string]interface{}{}
+	if err := c.getJsonData(endpointUrl, &jsonMap); err != nil {
+		return nil, err
+	}
+
+	return jsonMap, nil
+
+}
+
+// Poll the rebalance progress until the rebalance is done, and then make
+// sure the cluster ended up balanced, since a failed or stopped rebalance
+// also shows up as "no rebalance running".
+func (c CouchbaseCluster) WaitUntilRebalanceFinished(liveNodeIp string) error {
+
+	c.logger().Infof("WaitUntilRebalanceFinished()")
+
+	worker := func() (bool, error) {
+
+		isRebalancing, err := c.IsRebalancing(liveNodeIp)
+		if err != nil {
+			c.logger().Warnf("IsRebalancing returned err: %v.  Will retry", err)
+			return false, nil
+		}
+		if isRebalancing {
+			c.logger().Infof("Rebalance in progress")
+			return false, nil
+		}
+		return true, nil
+
+	}
+
+	sleeper := func(numAttempts int) (bool, int) {
+		if numAttempts > activeConfig.MaxRetriesJoinCluster*100 {
+			return false, -1
+		}
+		return true, 10
+	}
+
+	if err := RetryLoop(worker, sleeper); err != nil {
+		c.RecordEvent(EVENT_REBALANCE_FAILED, "Gave up waiting for the rebalance to finish: %v", err)
+		return err
+	}
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default", liveNodeIp, c.LocalCouchbasePort)
+
+	jsonMap := map[string]interface{}{}
+	if err := c.getJsonData(endpointUrl, &jsonMap); err != nil {
+		return err
+	}
+
+	balanced, ok := jsonMap["balanced"].(bool)
+	if ok && !balanced {
+		c.RecordEvent(EVENT_REBALANCE_FAILED, "Rebalance finished, but the cluster is not balanced")
+		return fmt.Errorf("Rebalance finished, but the cluster is not balanced.  The rebalance may have failed")
+	}
+
+	c.logger().Infof("Rebalance finished")
+	c.RecordEvent(EVENT_REBALANCE_FINISHED, "Rebalance finished and the cluster is balanced")
+	return nil
+
+}
+
+// Record the desired replica number for bucket in etcd under
+// /couchbase.com/bucket-replicas/<bucket>
+func (c CouchbaseCluster) SetDesiredReplicaNumberEtcd(bucket string, replicaNumber int) error {
+
+	key := path.Join(KEY_BUCKET_REPLICAS, bucket)
+
+	_, err := c.etcdClient.Set(key, strconv.Itoa(replicaNumber), TTL_NONE)
+
+	return err
+
+}
+
+// Find the desired replica numbers stored in etcd, keyed by bucket name.
+func (c CouchbaseCluster) DesiredReplicaNumbersEtcd() (map[string]int, error) {
+
+	replicaNumbers := map[string]int{}
+
+	nodes, err := c.etcdChildren(KEY_BUCKET_REPLICAS)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subNode := range nodes {
+
+		_, bucket := path.Split(subNode.Key)
+		replicaNumber, err := strconv.Atoi(subNode.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid replica number for bucket %v: %v", bucket, subNode.Value)
+		}
+		replicaNumbers[bucket] = replicaNumber
+
+	}
+
+	return replicaNumbers, nil
+
+}
+
+// Make the replica number of every bucket found in etcd match the desired value.
+func (c CouchbaseCluster) ApplyDesiredReplicaNumbers(liveNodeIp string) error {
+
+	replicaNumbers, err := c.DesiredReplicaNumbersEtcd()
+	if err != nil {
+		return err
+	}
+
+	for bucket, replicaNumber := range replicaNumbers {
+		if err := c.SetBucketReplicaNumber(liveNodeIp, bucket, replicaNumber); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Connect to etcd, change the replica number of bucket on the cluster
+// and record it in etcd as the desired replica number.
+func SetReplicaNumber(etcdServers []string, bucket string, replicaNumber int) error {
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(etcdServers)
+	if err != nil {
+		return err
+	}
+
+	if err := couchbaseCluster.SetBucketReplicaNumber(liveNodeIp, bucket, replicaNumber); err != nil {
+		return err
+	}
+
+	return couchbaseCluster.SetDesiredReplicaNumberEtcd(bucket, replicaNumber)
+
+}
+
+// Connect to etcd and apply all of the desired replica numbers stored there.
+func ApplyReplicaNumbers(etcdServers []string) error {
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(etcdServers)
+	if err != nil {
+		return err
+	}
+
+	return couchbaseCluster.ApplyDesiredReplicaNumbers(liveNodeIp)
+
+}
@@ -0,0 +1,148 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Grow or shrink the cluster to c.NumNodes couchbase_node@N.service units.
+// New units are copies of the highest numbered existing unit.  When
+// shrinking, the highest numbered nodes are first rebalanced out of the
+// couchbase cluster, and only then are their units destroyed.
+func (c *CouchbaseFleet) Scale() error {
+
+	if c.NumNodes < 1 {
+		return fmt.Errorf("Need at least one node, got %v", c.NumNodes)
+	}
+
+	unitNumbers, err := c.couchbaseUnitNumbers()
+	if err != nil {
+		return err
+	}
+	if len(unitNumbers) == 0 {
+		return fmt.Errorf("No couchbase_node units found.  Use launch-cbs to launch a cluster first")
+	}
+
+	c.logger().Infof("Scaling from %v to %v nodes", len(unitNumbers), c.NumNodes)
+
+	switch {
+	case c.NumNodes == len(unitNumbers):
+		c.logger().Infof("Cluster already has %v nodes, nothing to do", c.NumNodes)
+		return nil
+	case c.NumNodes > len(unitNumbers):
+		return c.scaleUp(unitNumbers)
+	default:
+		return c.scaleDown(unitNumbers)
+	}
+
+}
+
+func (c *CouchbaseFleet) scaleUp(unitNumbers []int) error {
+
+	highestUnitNumber := unitNumbers[len(unitNumbers)-1]
+
+	fleetUnitJson, err := c.getFleetUnitJson(couchbaseUnitName(highestUnitNumber))
+	if err != nil {
+		return err
+	}
+
+	// new units inherit the placement constraints of the existing ones
+	fleetUnit := FleetUnit{}
+	if err := json.Unmarshal([]byte(fleetUnitJson), &fleetUnit); err != nil {
+		return err
+	}
+	c.MachineMetadata = unitMachineMetadata(fleetUnit)
+
+	if err := c.verifyEnoughMachinesAvailable(); err != nil {
+		return err
+	}
+
+	numNewUnits := c.NumNodes - len(unitNumbers)
+	unitNames := []string{}
+	for i := highestUnitNumber + 1; i <= highestUnitNumber+numNewUnits; i++ {
+		if err := c.submitAndLaunchFleetUnitN(i, fleetUnitJson); err != nil {
+			return err
+		}
+		unitNames = append(unitNames, couchbaseUnitName(i))
+	}
+
+	if err := c.waitUntilUnitsActive(unitNames); err != nil {
+		return err
+	}
+
+	c.logger().Infof("Waiting for %v nodes to be up ..", c.NumNodes)
+	if err := WaitUntilNumNodesRunning(c.NumNodes, c.EtcdServers); err != nil {
+		return err
+	}
+
+	c.logger().Infof("Cluster scaled up to %v nodes", c.NumNodes)
+
+	return nil
+
+}
+
+func (c *CouchbaseFleet) scaleDown(unitNumbers []int) error {
+
+	removeUnitNumbers := unitNumbers[c.NumNodes:]
+
+	unitIps, err := c.fleetUnitMachineIps()
+	if err != nil {
+		return err
+	}
+
+	removeIps := []string{}
+	isRemoved := map[string]bool{}
+	for _, unitNumber := range removeUnitNumbers {
+		unitName := couchbaseUnitName(unitNumber)
+		ip, ok := unitIps[unitName]
+		if !ok {
+			c.logger().Infof("Unit %v is not running on any machine", unitName)
+			continue
+		}
+		removeIps = append(removeIps, ip)
+		isRemoved[ip] = true
+	}
+
+	if len(removeIps) > 0 {
+
+		couchbaseCluster := NewCouchbaseCluster(c.EtcdServers)
+		if err := couchbaseCluster.LoadAdminCredsFromEtcd(); err != nil {
+			return err
+		}
+		StupidPortHack(couchbaseCluster)
+
+		// talk to a node that is staying in the cluster
+		liveNodeIps, err := couchbaseCluster.FindLiveNodes()
+		if err != nil {
+			return err
+		}
+		liveNodeIp := ""
+		for _, ip := range liveNodeIps {
+			if !isRemoved[ip] {
+				liveNodeIp = ip
+				break
+			}
+		}
+		if liveNodeIp == "" {
+			return fmt.Errorf("No live node found that is staying in the cluster")
+		}
+
+		if err := couchbaseCluster.RebalanceOutNodes(liveNodeIp, removeIps); err != nil {
+			return err
+		}
+
+	}
+
+	for _, unitNumber := range removeUnitNumbers {
+		unitName := couchbaseUnitName(unitNumber)
+		c.logger().Infof("Destroying unit: %v", unitName)
+		if err := c.fleetClient.DestroyUnit(unitName); err != nil {
+			return err
+		}
+	}
+
+	c.logger().Infof("Cluster scaled down to %v nodes", c.NumNodes)
+
+	return nil
+
+}
@@ -0,0 +1,350 @@
+package cbcluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	KEY_SEED_DATA         = "/couchbase.com/seed-data"
+	MAX_SEED_DOC_ATTEMPTS = 3
+)
+
+// A seed document to be loaded into a bucket
+type SeedDoc struct {
+	Key   string
+	Value []byte
+}
+
+// The outcome of a seed data load, recorded in etcd under
+// /couchbase.com/seed-data/<bucket> so that the load is never repeated.
+type SeedResult struct {
+	Loaded int       `json:"loaded"`
+	Failed int       `json:"failed"`
+	Time   time.Time `json:"time"`
+}
+
+// Load seed docs from seedPath, which is either a directory of <key>.json
+// files, or a JSON-lines file where each line is a document whose key is
+// taken from its "_id" field.  Returns the docs along with the number of
+// entries that could not be turned into docs.
+func LoadSeedDocs(seedPath string) ([]SeedDoc, int, error) {
+
+	fileInfo, err := os.Stat(seedPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if fileInfo.IsDir() {
+		return loadSeedDocsFromDir(seedPath)
+	}
+	return loadSeedDocsFromJsonLines(seedPath)
+
+}
+
+func loadSeedDocsFromDir(dir string) ([]SeedDoc, int, error) {
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seedDocs := []SeedDoc{}
+	failed := 0
+
+	for _, fileInfo := range fileInfos {
+
+		if fileInfo.IsDir() || filepath.Ext(fileInfo.Name()) != ".json" {
+			continue
+		}
+
+		value, err := ioutil.ReadFile(filepath.Join(dir, fileInfo.Name()))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var doc interface{}
+		if err := json.Unmarshal(value, &doc); err != nil {
+			defaultLogger.Warnf("Seed doc %v is not valid json, skipping: %v", fileInfo.Name(), err)
+			failed += 1
+			continue
+		}
+
+		seedDocs = append(seedDocs, SeedDoc{
+			Key:   strings.TrimSuffix(fileInfo.Name(), ".json"),
+			Value: value,
+		})
+
+	}
+
+	return seedDocs, failed, nil
+
+}
+
+func loadSeedDocsFromJsonLines(fileName string) ([]SeedDoc, int, error) {
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	seedDocs := []SeedDoc{}
+	failed := 0
+	lineNumber := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 20*1024*1024) // couchbase docs can be up to 20 MB
+	for scanner.Scan() {
+
+		lineNumber += 1
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			defaultLogger.Warnf("Line %v of %v is not a json object, skipping: %v", lineNumber, fileName, err)
+			failed += 1
+			continue
+		}
+
+		key, ok := doc["_id"].(string)
+		if !ok || key == "" {
+			defaultLogger.Warnf("Line %v of %v has no _id, skipping", lineNumber, fileName)
+			failed += 1
+			continue
+		}
+
+		seedDocs = append(seedDocs, SeedDoc{Key: key, Value: []byte(line)})
+
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return seedDocs, failed, nil
+
+}
+
+// Write the seed docs into bucket through the data port of the nodes that
+// own each document's vbucket.  Returns the number of docs written and
+// the number that failed.
+func (c CouchbaseCluster) WriteSeedDocs(liveNodeIp, bucket, bucketPassword string, seedDocs []SeedDoc) (int, int, error) {
+
+	c.logger().Infof("WriteSeedDocs() called with %v docs for bucket: %v", len(seedDocs), bucket)
+
+	serverList, vbucketMap, err := c.getVbucketMap(liveNodeIp, bucket)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// keyed by server address, since a re-fetched map may list the servers
+	// in another order
+	conns := map[string]*memcachedConn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.close()
+		}
+	}()
+
+	loaded := 0
+	failed := 0
+
+	for _, seedDoc := range seedDocs {
+
+		var setErr error
+
+	attempts:
+		for attempt := 0; attempt < MAX_SEED_DOC_ATTEMPTS; attempt++ {
+
+			vbucket := vbucketForKey(seedDoc.Key, len(vbucketMap))
+			serverIndex := vbucketMap[vbucket]
+			if serverIndex < 0 || serverIndex >= len(serverList) {
+				return loaded, failed, fmt.Errorf("No master for vbucket %v", vbucket)
+			}
+			addr := serverList[serverIndex]
+
+			conn, ok := conns[addr]
+			if !ok {
+				conn, err = dialMemcached(addr, bucket, bucketPassword)
+				if err != nil {
+					return loaded, failed, err
+				}
+				conns[addr] = conn
+			}
+
+			setErr = conn.set(vbucket, seedDoc.Key, seedDoc.Value)
+			if setErr == nil {
+				break
+			}
+
+			statusErr, isStatusErr := setErr.(memcachedStatusError)
+			switch {
+			case isStatusErr && statusErr.status == MEMCACHED_STATUS_NOT_MY_VBUCKET:
+				// the vbucket moved, ie during a rebalance
+				c.logger().Infof("Vbucket %v is not on %v, fetching the vbucket map again", vbucket, addr)
+				serverList, vbucketMap, err = c.getVbucketMap(liveNodeIp, bucket)
+				if err != nil {
+					return loaded, failed, err
+				}
+			case isStatusErr:
+				break attempts // the doc itself was refused
+			default:
+				// after a broken socket or a protocol desync the
+				// connection is useless, so dial again
+				c.logger().Warnf("Connection to %v failed, reconnecting: %v", addr, setErr)
+				conn.close()
+				delete(conns, addr)
+			}
+
+		}
+
+		if setErr != nil {
+			c.logger().Warnf("Failed to write seed doc %v: %v", seedDoc.Key, setErr)
+			failed += 1
+			continue
+		}
+		loaded += 1
+
+	}
+
+	return loaded, failed, nil
+
+}
+
+// Get the data port addresses of the bucket's servers, and for each
+// vbucket, the index of its master in that list.
+func (c CouchbaseCluster) getVbucketMap(liveNodeIp, bucket string) ([]string, []int, error) {
+
+	bucketMap, err := c.GetBucket(liveNodeIp, bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverMap, ok := bucketMap["vBucketServerMap"].(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("No vBucketServerMap for bucket %v", bucket)
+	}
+	serverListRaw, ok := serverMap["serverList"].([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("No serverList for bucket %v", bucket)
+	}
+	vbucketMapRaw, ok := serverMap["vBucketMap"].([]interface{})
+	if !ok || len(vbucketMapRaw) == 0 {
+		return nil, nil, fmt.Errorf("No vBucketMap for bucket %v", bucket)
+	}
+
+	serverList := []string{}
+	for _, server := range serverListRaw {
+		addr, _ := server.(string)
+		serverList = append(serverList, addr)
+	}
+
+	// each vbucket entry is [master index, replica index, ..]
+	vbucketMap := []int{}
+	for vbucket, vbucketEntryRaw := range vbucketMapRaw {
+		vbucketEntry, ok := vbucketEntryRaw.([]interface{})
+		if !ok || len(vbucketEntry) == 0 {
+			return nil, nil, fmt.Errorf("Unexpected vBucketMap entry for vbucket %v", vbucket)
+		}
+		serverIndex, ok := vbucketEntry[0].(float64)
+		if !ok {
+			return nil, nil, fmt.Errorf("No master for vbucket %v", vbucket)
+		}
+		vbucketMap = append(vbucketMap, int(serverIndex))
+	}
+
+	return serverList, vbucketMap, nil
+
+}
+
+// Find the result of an earlier seed data load into bucket, or nil if
+// there never was one.
+func (c CouchbaseCluster) SeedResultEtcd(bucket string) (*SeedResult, error) {
+
+	response, err := c.etcdClient.Get(path.Join(KEY_SEED_DATA, bucket), false, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	result := &SeedResult{}
+	if err := json.Unmarshal([]byte(response.Node.Value), result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+
+}
+
+func (c CouchbaseCluster) setSeedResultEtcd(bucket string, result SeedResult) error {
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.etcdClient.Set(path.Join(KEY_SEED_DATA, bucket), string(resultJson), TTL_NONE)
+	return err
+
+}
+
+// Load the seed data in c.SeedDataPath into c.SeedBucket on the local node,
+// unless that was already done before.
+func (c CouchbaseCluster) LoadInitialSeedData() error {
+
+	c.logger().Infof("LoadInitialSeedData() called with: %v", c.SeedDataPath)
+
+	previous, err := c.SeedResultEtcd(c.SeedBucket)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		c.logger().Infof("Seed data already loaded into %v at %v, skipping", c.SeedBucket, previous.Time)
+		return nil
+	}
+
+	seedDocs, failedToParse, err := LoadSeedDocs(c.SeedDataPath)
+	if err != nil {
+		return err
+	}
+
+	if err := c.WaitUntilBucketReady(c.LocalCouchbaseIp, c.SeedBucket); err != nil {
+		return err
+	}
+
+	loaded, failed, err := c.WriteSeedDocs(c.LocalCouchbaseIp, c.SeedBucket, c.SeedBucketPassword, seedDocs)
+	if err != nil {
+		return err
+	}
+
+	// recording the result means never trying again, so a load where
+	// every doc failed is not recorded
+	if loaded == 0 && len(seedDocs) > 0 {
+		return fmt.Errorf("None of the %v seed docs could be written into %v", len(seedDocs), c.SeedBucket)
+	}
+
+	result := SeedResult{
+		Loaded: loaded,
+		Failed: failed + failedToParse,
+		Time:   time.Now().UTC(),
+	}
+
+	c.logger().Infof("Seed data loaded into %v.  Loaded: %v Failed: %v", c.SeedBucket, result.Loaded, result.Failed)
+
+	return c.setSeedResultEtcd(c.SeedBucket, result)
+
+}
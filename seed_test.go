@@ -0,0 +1,182 @@
+package cbcluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A data port that answers every request with the status returned by
+// respond, or drops the connection if respond returns -1.
+type fakeMemcached struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	stored   map[string]string
+	respond  func(opcode byte, key string) int
+}
+
+func startFakeMemcached(t *testing.T, respond func(opcode byte, key string) int) *fakeMemcached {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeMemcached{listener: listener, stored: map[string]string{}, respond: respond}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+
+}
+
+func (fake *fakeMemcached) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	for {
+
+		header := make([]byte, MEMCACHED_HEADER_LEN)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		extrasLen := int(header[4])
+		keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+		key := string(body[extrasLen : extrasLen+keyLen])
+
+		fake.mutex.Lock()
+		status := fake.respond(header[1], key)
+		if status == 0 && header[1] == MEMCACHED_OP_SET {
+			fake.stored[key] = string(body[extrasLen+keyLen:])
+		}
+		fake.mutex.Unlock()
+
+		if status < 0 {
+			return
+		}
+
+		response := make([]byte, MEMCACHED_HEADER_LEN)
+		response[0] = MEMCACHED_RES_MAGIC
+		response[1] = header[1]
+		binary.BigEndian.PutUint16(response[6:8], uint16(status))
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+
+	}
+
+}
+
+// Serve the bucket endpoint with a vbucket map of a single vbucket on the
+// fake data port, and count how often it is fetched.
+func startFakeBucketEndpoint(t *testing.T, dataAddr string, numFetches *int) (*httptest.Server, CouchbaseCluster) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*numFetches += 1
+		fmt.Fprintf(w, `{"vBucketServerMap":{"serverList":[%q],"vBucketMap":[[0]]}}`, dataAddr)
+	}))
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	return server, CouchbaseCluster{LocalCouchbasePort: port}
+
+}
+
+func TestWriteSeedDocsReconnectsAfterBrokenConnection(t *testing.T) {
+
+	dropped := false
+	fake := startFakeMemcached(t, func(opcode byte, key string) int {
+		if opcode == MEMCACHED_OP_SET && key == "doc1" && !dropped {
+			dropped = true
+			return -1
+		}
+		return 0
+	})
+	defer fake.listener.Close()
+
+	numFetches := 0
+	server, c := startFakeBucketEndpoint(t, fake.listener.Addr().String(), &numFetches)
+	defer server.Close()
+
+	seedDocs := []SeedDoc{{Key: "doc1", Value: []byte(`{"a":1}`)}, {Key: "doc2", Value: []byte(`{"b":2}`)}}
+	loaded, failed, err := c.WriteSeedDocs("127.0.0.1", "default", "", seedDocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 2 || failed != 0 {
+		t.Fatalf("Expected both docs to load after reconnecting, got loaded: %v failed: %v", loaded, failed)
+	}
+	if fake.stored["doc1"] != `{"a":1}` || fake.stored["doc2"] != `{"b":2}` {
+		t.Fatalf("Unexpected stored docs: %v", fake.stored)
+	}
+
+}
+
+func TestWriteSeedDocsRefetchesMapOnNotMyVbucket(t *testing.T) {
+
+	refused := false
+	fake := startFakeMemcached(t, func(opcode byte, key string) int {
+		if opcode == MEMCACHED_OP_SET && !refused {
+			refused = true
+			return MEMCACHED_STATUS_NOT_MY_VBUCKET
+		}
+		return 0
+	})
+	defer fake.listener.Close()
+
+	numFetches := 0
+	server, c := startFakeBucketEndpoint(t, fake.listener.Addr().String(), &numFetches)
+	defer server.Close()
+
+	loaded, failed, err := c.WriteSeedDocs("127.0.0.1", "default", "", []SeedDoc{{Key: "doc1", Value: []byte(`{}`)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 1 || failed != 0 {
+		t.Fatalf("Expected the doc to load after fetching the map again, got loaded: %v failed: %v", loaded, failed)
+	}
+	if numFetches != 2 {
+		t.Fatalf("Expected the vbucket map to be fetched twice, got %v", numFetches)
+	}
+
+}
+
+func TestWriteSeedDocsRefusedDocFails(t *testing.T) {
+
+	fake := startFakeMemcached(t, func(opcode byte, key string) int {
+		if opcode == MEMCACHED_OP_SET && key == "too-big" {
+			return 0x03 // value too large
+		}
+		return 0
+	})
+	defer fake.listener.Close()
+
+	numFetches := 0
+	server, c := startFakeBucketEndpoint(t, fake.listener.Addr().String(), &numFetches)
+	defer server.Close()
+
+	seedDocs := []SeedDoc{{Key: "too-big", Value: []byte(`{}`)}, {Key: "fine", Value: []byte(`{}`)}}
+	loaded, failed, err := c.WriteSeedDocs("127.0.0.1", "default", "", seedDocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 1 || failed != 1 || numFetches != 1 {
+		t.Fatalf("Expected one doc to fail without retrying, got loaded: %v failed: %v fetches: %v", loaded, failed, numFetches)
+	}
+
+}
@@ -0,0 +1,318 @@
+package cbcluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SERVICE_MANAGER_AUTO     = "auto"
+	SERVICE_MANAGER_SYSVINIT = "sysvinit"
+	SERVICE_MANAGER_SYSTEMD  = "systemd"
+	SERVICE_MANAGER_EXEC     = "exec"
+
+	COUCHBASE_SERVICE_NAME         = "couchbase-server"
+	COUCHBASE_SYSVINIT_SCRIPT      = "/etc/init.d/couchbase-server"
+	DEFAULT_COUCHBASE_EXEC_COMMAND = "/opt/couchbase/bin/couchbase-server -- -noinput"
+	SYSTEMD_RUNTIME_DIR            = "/run/systemd/system" // only present when booted with systemd
+	COUCHBASE_PROBE_TIMEOUT        = time.Second * 5
+)
+
+var SERVICE_MANAGERS = []string{
+	SERVICE_MANAGER_AUTO,
+	SERVICE_MANAGER_SYSVINIT,
+	SERVICE_MANAGER_SYSTEMD,
+	SERVICE_MANAGER_EXEC,
+}
+
+// Starts the local couchbase server and tells whether it is running.
+// Exited and Stop only matter for a manager that runs couchbase as a child
+// of the node daemon: Exited delivers the error when the child exits, so
+// that the daemon can exit too, and Stop kills it.  Managers that leave
+// couchbase to the init system return a nil channel and do nothing on Stop.
+type ServiceManager interface {
+	Name() string
+	Start() error
+	Running() (bool, error)
+	Exited() <-chan error
+	Stop() error
+}
+
+// Create the service manager with the given name.  The auto manager picks
+// systemd if the machine was booted with it, otherwise sysvinit if there is
+// an init script, and otherwise runs couchbase-server directly, which is
+// what happens in a container without an init system.
+func NewServiceManager(name string) (ServiceManager, error) {
+
+	switch name {
+	case SERVICE_MANAGER_AUTO, "":
+		return NewServiceManager(detectServiceManager())
+	case SERVICE_MANAGER_SYSVINIT:
+		return sysvinitServiceManager{}, nil
+	case SERVICE_MANAGER_SYSTEMD:
+		return systemdServiceManager{}, nil
+	case SERVICE_MANAGER_EXEC:
+		commandLine := strings.Fields(activeConfig.CouchbaseExecCommand)
+		if len(commandLine) == 0 {
+			return nil, fmt.Errorf("The couchbase exec command must not be empty")
+		}
+		return &execServiceManager{
+			command: commandLine[0],
+			args:    commandLine[1:],
+			exitErr: make(chan error, 1),
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown service manager: %v.  Use one of: %v", name, strings.Join(SERVICE_MANAGERS, ", "))
+	}
+
+}
+
+func detectServiceManager() string {
+
+	if _, err := os.Stat(SYSTEMD_RUNTIME_DIR); err == nil {
+		return SERVICE_MANAGER_SYSTEMD
+	}
+	if _, err := os.Stat(COUCHBASE_SYSVINIT_SCRIPT); err == nil {
+		return SERVICE_MANAGER_SYSVINIT
+	}
+	return SERVICE_MANAGER_EXEC
+
+}
+
+func isServiceManagerName(name string) bool {
+	for _, knownName := range SERVICE_MANAGERS {
+		if knownName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Start couchbase with the service manager and wait until it reports that
+// couchbase is running, retrying the start if it does not.
+func StartCouchbaseService(serviceManager ServiceManager) error {
+
+	defaultLogger.Infof("StartCouchbaseService() with service manager: %v", serviceManager.Name())
+
+	for i := 0; i < activeConfig.MaxRetriesStartCouchbase; i++ {
+
+		if err := serviceManager.Start(); err != nil {
+			defaultLogger.Warnf("Starting couchbase returned error: %v", err)
+			return err
+		}
+
+		running, err := serviceManager.Running()
+		if err != nil {
+			return err
+		}
+		if running {
+			defaultLogger.Infof("Couchbase service running")
+			return nil
+		}
+
+		defaultLogger.Infof("Couchbase service not running, sleep and try again")
+
+		<-time.After(time.Second * 10)
+
+	}
+
+	return fmt.Errorf("Unable to start couchbase service after several retries")
+
+}
+
+// The couchbase-server init script run via "service"
+type sysvinitServiceManager struct{}
+
+func (m sysvinitServiceManager) Name() string {
+	return SERVICE_MANAGER_SYSVINIT
+}
+
+func (m sysvinitServiceManager) Start() error {
+	return exec.Command("service", COUCHBASE_SERVICE_NAME, "start").Run()
+}
+
+func (m sysvinitServiceManager) Running() (bool, error) {
+
+	cmd := exec.Command("service", COUCHBASE_SERVICE_NAME, "status")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		// service x status returns a non-zero exit code if
+		// the service is not running, which causes cmd.CombinedOutput
+		// to return an error.   however, absorb the error and turn it
+		// into a "not running" signal rather than propagating an error.
+		return false, nil
+	}
+	defaultLogger.Debugf("Checking status returned output: %v", string(output))
+
+	return strings.Contains(string(output), "is running"), nil
+
+}
+
+func (m sysvinitServiceManager) Exited() <-chan error {
+	return nil
+}
+
+func (m sysvinitServiceManager) Stop() error {
+	return nil
+}
+
+// The couchbase-server unit run via systemctl
+type systemdServiceManager struct{}
+
+func (m systemdServiceManager) Name() string {
+	return SERVICE_MANAGER_SYSTEMD
+}
+
+func (m systemdServiceManager) Start() error {
+
+	output, err := exec.Command("systemctl", "start", COUCHBASE_SERVICE_NAME).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl start %v failed: %v.  Output: %v", COUCHBASE_SERVICE_NAME, err, string(output))
+	}
+	return nil
+
+}
+
+func (m systemdServiceManager) Running() (bool, error) {
+
+	// exits with a non-zero code unless the unit is active
+	output, err := exec.Command("systemctl", "is-active", COUCHBASE_SERVICE_NAME).CombinedOutput()
+	defaultLogger.Debugf("Checking status returned output: %v", strings.TrimSpace(string(output)))
+	return err == nil, nil
+
+}
+
+func (m systemdServiceManager) Exited() <-chan error {
+	return nil
+}
+
+func (m systemdServiceManager) Stop() error {
+	return nil
+}
+
+// Runs couchbase-server as a child of the node daemon, for containers that
+// have no init system.  The daemon owns the process: its output goes to the
+// daemon's stdout and stderr, and if it exits, it is not restarted here.
+// Instead the exit is sent on exitErr and the daemon exits, so that fleet
+// restarts the whole unit.
+type execServiceManager struct {
+	command string
+	args    []string
+	exitErr chan error // buffered, holds the exit of the last child
+
+	mutex  sync.Mutex
+	cmd    *exec.Cmd
+	exited bool
+}
+
+func (m *execServiceManager) Name() string {
+	return SERVICE_MANAGER_EXEC
+}
+
+func (m *execServiceManager) Start() error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.cmd != nil && !m.exited {
+		return nil // already running
+	}
+
+	// forget the exit of an earlier child, since this one replaces it
+	select {
+	case <-m.exitErr:
+	default:
+	}
+
+	cmd := exec.Command(m.command, m.args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to run %v: %v", m.command, err)
+	}
+	defaultLogger.Infof("Started %v with pid %v", m.command, cmd.Process.Pid)
+
+	m.cmd = cmd
+	m.exited = false
+
+	// reap the process, so that it does not linger as a zombie
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			err = fmt.Errorf("%v exited", m.command)
+		} else {
+			err = fmt.Errorf("%v exited: %v", m.command, err)
+		}
+		defaultLogger.Errorf("%v", err)
+
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.exited = true
+		select {
+		case m.exitErr <- err:
+		default:
+		}
+	}()
+
+	return nil
+
+}
+
+// The child is running once the couchbase REST port answers, which takes a
+// while after the process starts.
+func (m *execServiceManager) Running() (bool, error) {
+
+	m.mutex.Lock()
+	started := m.cmd != nil && !m.exited
+	m.mutex.Unlock()
+
+	if !started {
+		return false, nil
+	}
+
+	return couchbaseRestAnswers(), nil
+
+}
+
+func (m *execServiceManager) Exited() <-chan error {
+	return m.exitErr
+}
+
+func (m *execServiceManager) Stop() error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.cmd == nil || m.exited {
+		return nil
+	}
+
+	defaultLogger.Infof("Killing %v with pid %v", m.command, m.cmd.Process.Pid)
+	return m.cmd.Process.Kill()
+
+}
+
+// Does the local couchbase answer on its REST port?  Any response counts,
+// since the admin credentials may not be set up yet.
+func couchbaseRestAnswers() bool {
+
+	endpointUrl := fmt.Sprintf("http://127.0.0.1:%v/pools", activeConfig.CouchbasePort)
+
+	client := &http.Client{Timeout: COUCHBASE_PROBE_TIMEOUT}
+	resp, err := client.Get(endpointUrl)
+	if err != nil {
+		defaultLogger.Debugf("Couchbase not answering on %v yet: %v", endpointUrl, err)
+		return false
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	return true
+
+}
@@ -0,0 +1,161 @@
+package cbcluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create an exec service manager running commandLine, with the couchbase
+// port pointing at a server that always answers, so that Running only
+// depends on the child.  Call the returned func to restore the config.
+func newTestExecServiceManager(t *testing.T, commandLine string) (*execServiceManager, func()) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedConfig := activeConfig
+	activeConfig.CouchbaseExecCommand = commandLine
+	activeConfig.CouchbasePort = serverUrl.Port()
+
+	restore := func() {
+		activeConfig = savedConfig
+		server.Close()
+	}
+
+	serviceManager, err := NewServiceManager(SERVICE_MANAGER_EXEC)
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+
+	return serviceManager.(*execServiceManager), restore
+
+}
+
+func waitForExit(t *testing.T, serviceManager ServiceManager) error {
+
+	select {
+	case err := <-serviceManager.Exited():
+		return err
+	case <-time.After(time.Second * 10):
+		t.Fatalf("Child did not exit")
+	}
+	return nil
+
+}
+
+// Wait until the child has exited without reading Exited
+func waitUntilNotRunning(t *testing.T, serviceManager ServiceManager) {
+
+	for i := 0; i < 100; i++ {
+		running, err := serviceManager.Running()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !running {
+			return
+		}
+		<-time.After(time.Millisecond * 100)
+	}
+	t.Fatalf("Child still running")
+
+}
+
+func TestExecServiceManagerExited(t *testing.T) {
+
+	serviceManager, restore := newTestExecServiceManager(t, "false")
+	defer restore()
+
+	if err := serviceManager.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := waitForExit(t, serviceManager)
+	if err == nil || !strings.Contains(err.Error(), "false exited: exit status 1") {
+		t.Errorf("Unexpected exit error: %v", err)
+	}
+
+	running, err := serviceManager.Running()
+	if err != nil || running {
+		t.Errorf("Expected an exited child to not be running, got %v (err: %v)", running, err)
+	}
+
+	// the child is gone, so there is nothing to kill
+	if err := serviceManager.Stop(); err != nil {
+		t.Errorf("Stop after the child exited returned: %v", err)
+	}
+
+}
+
+func TestExecServiceManagerRestart(t *testing.T) {
+
+	serviceManager, restore := newTestExecServiceManager(t, "sleep 1")
+	defer restore()
+
+	if err := serviceManager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	running, err := serviceManager.Running()
+	if err != nil || !running {
+		t.Fatalf("Expected the child to be running, got %v (err: %v)", running, err)
+	}
+
+	// leave the exit of the first child unread
+	waitUntilNotRunning(t, serviceManager)
+
+	if err := serviceManager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	running, err = serviceManager.Running()
+	if err != nil || !running {
+		t.Fatalf("Expected the restarted child to be running, got %v (err: %v)", running, err)
+	}
+
+	// the exit of the first child must not be mistaken for the second one
+	select {
+	case err := <-serviceManager.Exited():
+		t.Fatalf("Got an exit while the restarted child is running: %v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	if err := serviceManager.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	err = waitForExit(t, serviceManager)
+	if err == nil || !strings.Contains(err.Error(), "sleep exited: signal: killed") {
+		t.Errorf("Unexpected exit error: %v", err)
+	}
+
+	if err := serviceManager.Stop(); err != nil {
+		t.Errorf("Stop after the child was killed returned: %v", err)
+	}
+
+}
+
+func TestExecServiceManagerStartFails(t *testing.T) {
+
+	serviceManager, restore := newTestExecServiceManager(t, "/nonexistent/couchbase-server")
+	defer restore()
+
+	if err := serviceManager.Start(); err == nil {
+		t.Errorf("Expected starting a missing command to fail")
+	}
+
+	running, err := serviceManager.Running()
+	if err != nil || running {
+		t.Errorf("Expected a child that never started to not be running, got %v (err: %v)", running, err)
+	}
+	if err := serviceManager.Stop(); err != nil {
+		t.Errorf("Stop without a child returned: %v", err)
+	}
+
+}
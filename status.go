@@ -0,0 +1,241 @@
+package cbcluster
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A report on the cluster combining what the nodes published in etcd with
+// what couchbase itself says.  Problems lists anything that looks wrong,
+// such as nodes that only one of the two knows about.
+type ClusterStatus struct {
+	QueriedNode     string       `json:"queriedNode"` // the node /pools/default was fetched from
+	Nodes           []NodeStatus `json:"nodes"`
+	Buckets         []string     `json:"buckets"`
+	RebalanceStatus string       `json:"rebalanceStatus"` // ie, none or running
+	Balanced        *bool        `json:"balanced,omitempty"`
+	Problems        []string     `json:"problems"`
+}
+
+type NodeStatus struct {
+	Ip                string   `json:"ip"`
+	Port              string   `json:"port,omitempty"`
+	InEtcd            bool     `json:"inEtcd"`
+	InCouchbase       bool     `json:"inCouchbase"`
+	EtcdState         string   `json:"etcdState,omitempty"` // the value published under /couchbase.com/couchbase-node-state/<ip>
+	Status            string   `json:"status,omitempty"`
+	ClusterMembership string   `json:"clusterMembership,omitempty"`
+	Version           string   `json:"version,omitempty"`
+	Services          []string `json:"services,omitempty"`
+	MemoryTotal       int64    `json:"memoryTotal,omitempty"`
+	MemoryFree        int64    `json:"memoryFree,omitempty"`
+}
+
+// Connect to etcd and build a status report of the cluster
+func GetClusterStatus(etcdServers []string) (*ClusterStatus, error) {
+
+	couchbaseCluster := NewCouchbaseCluster(etcdServers)
+	if err := couchbaseCluster.LoadAdminCredsFromEtcd(); err != nil {
+		return nil, err
+	}
+	StupidPortHack(couchbaseCluster)
+
+	return couchbaseCluster.ClusterStatus()
+
+}
+
+func (c CouchbaseCluster) ClusterStatus() (*ClusterStatus, error) {
+
+	status := &ClusterStatus{
+		Nodes:    []NodeStatus{},
+		Buckets:  []string{},
+		Problems: []string{},
+	}
+
+	etcdNodes, err := c.etcdChildren(KEY_NODE_STATE)
+	if err != nil {
+		return nil, err
+	}
+
+	nodesByIp := map[string]*NodeStatus{}
+	etcdIps := []string{}
+	for _, etcdNode := range etcdNodes {
+		_, nodeIp := path.Split(etcdNode.Key)
+		etcdIps = append(etcdIps, nodeIp)
+		nodesByIp[nodeIp] = &NodeStatus{
+			Ip:        nodeIp,
+			InEtcd:    true,
+			EtcdState: etcdNode.Value,
+		}
+	}
+
+	if len(etcdIps) == 0 {
+		status.Problems = append(status.Problems, fmt.Sprintf("No nodes have published their state in %v", KEY_NODE_STATE))
+		return status, nil
+	}
+
+	// ask the first node that answers, since some of them may be down
+	pool := struct {
+		Nodes    []PoolNode `json:"nodes"`
+		Balanced *bool      `json:"balanced"`
+	}{}
+	for _, nodeIp := range etcdIps {
+		endpointUrl := fmt.Sprintf("http://%v:%v/pools/default", nodeIp, c.LocalCouchbasePort)
+		if err := c.getJsonData(endpointUrl, &pool); err != nil {
+			status.Problems = append(status.Problems, fmt.Sprintf("Node %v is in etcd, but failed to get %v: %v", nodeIp, endpointUrl, err))
+			continue
+		}
+		status.QueriedNode = nodeIp
+		break
+	}
+
+	if status.QueriedNode == "" {
+		status.Problems = append(status.Problems, "None of the nodes in etcd answered, unable to get the couchbase cluster state")
+		status.Nodes = sortedNodeStatuses(nodesByIp)
+		return status, nil
+	}
+
+	for _, poolNode := range pool.Nodes {
+
+		nodeIp, port, err := net.SplitHostPort(poolNode.Hostname)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected hostname %v: %v", poolNode.Hostname, err)
+		}
+
+		nodeStatus, ok := nodesByIp[nodeIp]
+		if !ok {
+			nodeStatus = &NodeStatus{Ip: nodeIp}
+			nodesByIp[nodeIp] = nodeStatus
+		}
+		nodeStatus.Port = port
+		nodeStatus.InCouchbase = true
+		nodeStatus.Status = poolNode.Status
+		nodeStatus.ClusterMembership = poolNode.ClusterMembership
+		nodeStatus.Version = poolNode.Version
+		nodeStatus.Services = poolNode.Services
+		nodeStatus.MemoryTotal = poolNode.MemoryTotal
+		nodeStatus.MemoryFree = poolNode.MemoryFree
+
+	}
+
+	status.Nodes = sortedNodeStatuses(nodesByIp)
+	status.Balanced = pool.Balanced
+
+	for _, node := range status.Nodes {
+		switch {
+		case !node.InCouchbase:
+			status.Problems = append(status.Problems, fmt.Sprintf("Node %v is in etcd, but not in the couchbase cluster", node.Ip))
+		case !node.InEtcd:
+			status.Problems = append(status.Problems, fmt.Sprintf("Node %v is in the couchbase cluster, but not in etcd", node.Ip))
+		}
+		if node.InCouchbase && node.Status != "healthy" {
+			status.Problems = append(status.Problems, fmt.Sprintf("Node %v status is %v", node.Ip, node.Status))
+		}
+		if node.InCouchbase && node.ClusterMembership != "active" {
+			status.Problems = append(status.Problems, fmt.Sprintf("Node %v cluster membership is %v", node.Ip, node.ClusterMembership))
+		}
+	}
+
+	buckets, err := c.GetBucketNames(status.QueriedNode)
+	if err != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("Failed to get buckets: %v", err))
+	} else {
+		status.Buckets = buckets
+	}
+
+	rebalanceStatus, err := c.rebalanceStatus(status.QueriedNode)
+	if err != nil {
+		status.Problems = append(status.Problems, fmt.Sprintf("Failed to get rebalance status: %v", err))
+	}
+	status.RebalanceStatus = rebalanceStatus
+	if rebalanceStatus != "" && rebalanceStatus != "none" {
+		status.Problems = append(status.Problems, fmt.Sprintf("Rebalance status is %v", rebalanceStatus))
+	} else if status.Balanced != nil && !*status.Balanced {
+		status.Problems = append(status.Problems, "Cluster is not balanced, a rebalance is needed")
+	}
+
+	return status, nil
+
+}
+
+// Get the status field of /pools/default/rebalanceProgress, ie: none or running
+func (c CouchbaseCluster) rebalanceStatus(liveNodeIp string) (string, error) {
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default/rebalanceProgress", liveNodeIp, c.LocalCouchbasePort)
+
+	progress := struct {
+		Status string `json:"status"`
+	}{}
+	if err := c.getJsonData(endpointUrl, &progress); err != nil {
+		return "", err
+	}
+
+	return progress.Status, nil
+
+}
+
+func sortedNodeStatuses(nodesByIp map[string]*NodeStatus) []NodeStatus {
+
+	nodeIps := []string{}
+	for nodeIp := range nodesByIp {
+		nodeIps = append(nodeIps, nodeIp)
+	}
+	sort.Strings(nodeIps)
+
+	nodeStatuses := []NodeStatus{}
+	for _, nodeIp := range nodeIps {
+		nodeStatuses = append(nodeStatuses, *nodesByIp[nodeIp])
+	}
+
+	return nodeStatuses
+
+}
+
+// Write the report in the given format (text or json)
+func (status ClusterStatus) Write(w io.Writer, format string) error {
+
+	if err := validateOutputFormat(format); err != nil {
+		return err
+	}
+	if format == OUTPUT_FORMAT_JSON {
+		return writeJson(w, status, true)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "IP\tETCD\tCOUCHBASE\tSTATUS\tMEMBERSHIP\tVERSION\tSERVICES\tMEM FREE/TOTAL\n")
+	for _, node := range status.Nodes {
+		fmt.Fprintf(
+			tw,
+			"%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v/%v\n",
+			node.Ip,
+			node.InEtcd,
+			node.InCouchbase,
+			node.Status,
+			node.ClusterMembership,
+			node.Version,
+			strings.Join(node.Services, ","),
+			node.MemoryFree,
+			node.MemoryTotal,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nBuckets: %v\n", strings.Join(status.Buckets, ", "))
+	fmt.Fprintf(w, "Rebalance: %v\n", status.RebalanceStatus)
+	if len(status.Problems) == 0 {
+		fmt.Fprintf(w, "No problems found\n")
+		return nil
+	}
+	fmt.Fprintf(w, "\nProblems:\n")
+	for _, problem := range status.Problems {
+		fmt.Fprintf(w, "  %v\n", problem)
+	}
+	return nil
+
+}
@@ -0,0 +1,318 @@
+package cbcluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	KEY_SYNC_GW_CONFIG            = "/couchbase.com/sync-gateway/config"
+	DEFAULT_SYNC_GW_IMAGE_REPO    = "couchbase/sync-gateway"
+	SYNC_GW_PORT                  = "4984"
+	MAX_RETRIES_SYNC_GW_RESPONDS  = 60
+	SYNC_GW_HTTP_TIMEOUT          = time.Second * 5
+	SYNC_GW_CONTAINER_CONFIG_PATH = "/etc/sync_gateway/config.json"
+
+	// stands in for the couchbase node ip in the stored config, and is
+	// replaced with a live node by the unit each time it starts
+	SYNC_GW_NODE_IP_PLACEHOLDER = "COUCHBASE_NODE_IP_PLACEHOLDER"
+)
+
+// The sync gateway config.  The server url points at one of the live
+// couchbase nodes, which sync gateway uses to discover the rest of the cluster.
+// The node is picked when the unit starts rather than at launch, since the
+// nodes come and go with scaling, upgrades and failures.
+// The GUEST user is disabled, so anonymous clients get no access unless a
+// --config-template enables it.
+const DEFAULT_SYNC_GW_CONFIG_TEMPLATE = `
+{
+  "log": ["HTTP+"],
+  "interface": ":{{ .SYNC_GW_PORT }}",
+  "databases": {
+    "{{ .BUCKET }}": {
+      "server": "{{ .SERVER_URL }}",
+      "bucket": "{{ .BUCKET }}",
+      "users": {
+        "GUEST": {"disabled": true}
+      }
+    }
+  }
+}
+`
+
+// The sync gateway unit fetches its config from etcd when it starts, so
+// the config does not have to be squeezed into the unit, and fills in the
+// ip of a node that is currently publishing its state.  $$ is a literal $
+// for systemd.
+const DEFAULT_SYNC_GW_UNIT_TEMPLATE = `
+[Service]
+TimeoutStartSec=0
+EnvironmentFile=/etc/environment
+ExecStartPre=-/usr/bin/docker kill sync_gw
+ExecStartPre=-/usr/bin/docker rm sync_gw
+ExecStartPre=/usr/bin/docker pull {{ .IMAGE }}
+ExecStartPre=/bin/bash -c 'NODE_IP=$$(/usr/bin/etcdctl ls {{ .NODE_STATE_KEY }} | shuf -n 1 | xargs basename) && test -n "$$NODE_IP" && /usr/bin/etcdctl get {{ .CONFIG_KEY }} | sed "s/{{ .NODE_IP_PLACEHOLDER }}/$$NODE_IP/g" > /tmp/sync_gw_config.json'
+ExecStart=/usr/bin/docker run --name sync_gw --net=host -v /tmp/sync_gw_config.json:{{ .CONFIG_PATH }} {{ .IMAGE }} {{ .CONFIG_PATH }}
+ExecStop=/usr/bin/docker stop sync_gw
+
+[X-Fleet]
+Conflicts=sync_gw_node*.service
+`
+
+type SyncGwConfigParams struct {
+	SERVER_URL   string
+	BUCKET       string
+	SYNC_GW_PORT string
+}
+
+type SyncGwUnitParams struct {
+	IMAGE               string
+	CONFIG_KEY          string
+	CONFIG_PATH         string
+	NODE_STATE_KEY      string
+	NODE_IP_PLACEHOLDER string
+}
+
+// Launch c.NumNodes sync_gw_node@N.service units in front of the couchbase
+// cluster and wait until each sync gateway answers on its REST port.
+func (c CouchbaseFleet) LaunchSyncGateway() error {
+
+	c.logger().Infof("LaunchSyncGateway()")
+
+	if err := c.verifyEnoughMachinesAvailable(); err != nil {
+		return err
+	}
+
+	syncGwConfig, err := c.generateSyncGwConfig()
+	if err != nil {
+		return err
+	}
+
+	c.logger().Infof("Sync gateway config: %v", syncGwConfig)
+
+	if _, err := c.etcdClient.Set(KEY_SYNC_GW_CONFIG, syncGwConfig, TTL_NONE); err != nil {
+		return err
+	}
+
+	fleetUnitJson, err := c.generateSyncGwFleetUnitJson()
+	if err != nil {
+		return err
+	}
+
+	fleetUnit := FleetUnit{}
+	if err := json.Unmarshal([]byte(fleetUnitJson), &fleetUnit); err != nil {
+		return err
+	}
+
+	unitNames := []string{}
+	for i := 1; i <= c.NumNodes; i++ {
+		unitName := syncGwUnitName(i)
+		c.logger().Infof("Submitting unit: %v", unitName)
+		if err := c.fleetClient.CreateUnit(unitName, fleetUnit); err != nil {
+			return err
+		}
+		unitNames = append(unitNames, unitName)
+	}
+
+	if err := c.waitUntilUnitsActive(unitNames); err != nil {
+		return err
+	}
+
+	if err := c.waitUntilSyncGwsResponding(unitNames); err != nil {
+		return err
+	}
+
+	c.logger().Infof("Sync gateway is up!")
+
+	return nil
+
+}
+
+// Extract the args for launch-sgw
+func (c *CouchbaseFleet) ExtractSyncGwDocOptArgs(arguments map[string]interface{}) error {
+
+	numNodes, err := ExtractNumNodes(arguments)
+	if err != nil {
+		return err
+	}
+
+	c.NumNodes = numNodes
+	c.ContainerTag = ExtractDockerTagOrLatest(arguments)
+	c.SyncGwImageRepo, _ = ExtractStringArg(arguments, "--image-repo")
+	c.SyncGwBucket, _ = ExtractStringArg(arguments, "--bucket")
+
+	if configFile, err := ExtractStringArg(arguments, "--config-template"); err == nil {
+		configTemplate, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return err
+		}
+		c.SyncGwConfigTemplate = string(configTemplate)
+	}
+
+	if selectors, err := ExtractStringArg(arguments, "--machine-metadata"); err == nil {
+		c.MachineMetadata, err = ParseMachineMetadata(selectors)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Render the sync gateway config.  The server url has a placeholder for
+// the node ip, which the unit fills in when it starts.
+func (c CouchbaseFleet) generateSyncGwConfig() (string, error) {
+
+	couchbaseCluster := NewCouchbaseCluster(c.EtcdServers)
+	StupidPortHack(couchbaseCluster)
+
+	liveNodeIp, err := couchbaseCluster.FindLiveNode()
+	if err != nil {
+		return "", err
+	}
+	if liveNodeIp == "" {
+		return "", fmt.Errorf("No live couchbase node found in etcd.  Use launch-cbs to launch a cluster first")
+	}
+
+	configTemplate := c.SyncGwConfigTemplate
+	if configTemplate == "" {
+		configTemplate = DEFAULT_SYNC_GW_CONFIG_TEMPLATE
+	}
+
+	bucket := c.SyncGwBucket
+	if bucket == "" {
+		bucket = DEFAULT_BUCKET_NAME
+	}
+
+	params := SyncGwConfigParams{
+		SERVER_URL:   fmt.Sprintf("http://%v:%v", SYNC_GW_NODE_IP_PLACEHOLDER, couchbaseCluster.LocalCouchbasePort),
+		BUCKET:       bucket,
+		SYNC_GW_PORT: SYNC_GW_PORT,
+	}
+
+	tmpl, err := template.New("sync_gw_config").Parse(configTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, params); err != nil {
+		return "", err
+	}
+
+	// catch broken templates here rather than in a crash looping container
+	config := map[string]interface{}{}
+	if err := json.Unmarshal(out.Bytes(), &config); err != nil {
+		return "", fmt.Errorf("Sync gateway config is not valid json: %v", err)
+	}
+
+	return out.String(), nil
+
+}
+
+func (c CouchbaseFleet) generateSyncGwFleetUnitJson() (string, error) {
+
+	imageRepo := c.SyncGwImageRepo
+	if imageRepo == "" {
+		imageRepo = DEFAULT_SYNC_GW_IMAGE_REPO
+	}
+
+	params := SyncGwUnitParams{
+		IMAGE:               fmt.Sprintf("%v:%v", imageRepo, c.ContainerTag),
+		CONFIG_KEY:          KEY_SYNC_GW_CONFIG,
+		CONFIG_PATH:         SYNC_GW_CONTAINER_CONFIG_PATH,
+		NODE_STATE_KEY:      KEY_NODE_STATE,
+		NODE_IP_PLACEHOLDER: SYNC_GW_NODE_IP_PLACEHOLDER,
+	}
+
+	return renderFleetUnitJson(DEFAULT_SYNC_GW_UNIT_TEMPLATE, params, c.MachineMetadata)
+
+}
+
+// Wait until the sync gateway in each unit answers on its REST port
+func (c CouchbaseFleet) waitUntilSyncGwsResponding(unitNames []string) error {
+
+	httpClient := &http.Client{Timeout: SYNC_GW_HTTP_TIMEOUT}
+
+	worker := func() (bool, error) {
+
+		summaries, err := c.unitSummaries(unitNames)
+		if err != nil {
+			c.logger().Warnf("Failed to get unit states: %v.  Will retry", err)
+			return false, nil
+		}
+
+		for _, summary := range summaries {
+
+			if summary.MachineIP == "" {
+				c.logger().Infof("Unit %v has no machine yet", summary.Name)
+				return false, nil
+			}
+
+			endpointUrl := fmt.Sprintf("http://%v:%v/", summary.MachineIP, SYNC_GW_PORT)
+			resp, err := httpClient.Get(endpointUrl)
+			if err != nil {
+				c.logger().Infof("Sync gateway %v not responding yet: %v", endpointUrl, err)
+				return false, nil
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				c.logger().Infof("Sync gateway %v returned status: %v", endpointUrl, resp.StatusCode)
+				return false, nil
+			}
+
+			c.logger().Infof("Sync gateway %v is responding", endpointUrl)
+
+		}
+
+		return true, nil
+
+	}
+
+	sleeper := func(numAttempts int) (bool, int) {
+		if numAttempts > MAX_RETRIES_SYNC_GW_RESPONDS {
+			return false, -1
+		}
+		return true, 5
+	}
+
+	if err := RetryLoop(worker, sleeper); err != nil {
+		return fmt.Errorf("Sync gateways did not respond on port %v: %v", SYNC_GW_PORT, err)
+	}
+
+	return nil
+
+}
+
+func syncGwUnitName(unitNumber int) string {
+	return fmt.Sprintf("sync_gw_node@%v.service", unitNumber)
+}
+
+// Find the names of all sync_gw_node@N.service units in fleet
+func (c CouchbaseFleet) syncGwUnitNames() ([]string, error) {
+
+	units, err := c.fleetClient.Units()
+	if err != nil {
+		return nil, err
+	}
+
+	unitNames := []string{}
+	for _, unit := range units {
+		if strings.HasPrefix(unit.Name, "sync_gw_node@") && strings.HasSuffix(unit.Name, ".service") {
+			unitNames = append(unitNames, unit.Name)
+		}
+	}
+
+	sort.Strings(unitNames)
+
+	return unitNames, nil
+
+}
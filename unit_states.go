@@ -0,0 +1,137 @@
+package cbcluster
+
+import (
+	"fmt"
+)
+
+const (
+	MAX_RETRIES_UNITS_ACTIVE = 120
+)
+
+// Where a unit is running and what systemd thinks of it
+type UnitSummary struct {
+	Name        string
+	MachineID   string
+	MachineIP   string
+	ActiveState string // systemd active state, ie: active, activating, failed
+	SubState    string // systemd sub state, ie: running, start-pre, failed
+}
+
+// Get a summary of each of the units.  Units that fleet has not
+// scheduled yet have an empty machine and state.
+func (c CouchbaseFleet) unitSummaries(unitNames []string) ([]UnitSummary, error) {
+
+	machines, err := c.fleetClient.Machines()
+	if err != nil {
+		return nil, err
+	}
+	machineIps := map[string]string{}
+	for _, machine := range machines {
+		machineIps[machine.ID] = machine.PrimaryIP
+	}
+
+	states, err := c.fleetClient.UnitStates()
+	if err != nil {
+		return nil, err
+	}
+	statesByName := map[string]FleetUnitState{}
+	for _, state := range states {
+		statesByName[state.Name] = state
+	}
+
+	summaries := []UnitSummary{}
+	for _, unitName := range unitNames {
+		state := statesByName[unitName]
+		summaries = append(summaries, UnitSummary{
+			Name:        unitName,
+			MachineID:   state.MachineID,
+			MachineIP:   machineIps[state.MachineID],
+			ActiveState: state.SystemdActiveState,
+			SubState:    state.SystemdSubState,
+		})
+	}
+
+	return summaries, nil
+
+}
+
+// Poll the unit states until all units are active and running, reporting
+// each unit's state as it changes.  Fails as soon as a unit enters the
+// failed state rather than waiting for it to come up.
+func (c CouchbaseFleet) waitUntilUnitsActive(unitNames []string) error {
+
+	c.logger().Infof("Waiting for units to be active: %v", unitNames)
+
+	lastReported := map[string]UnitSummary{}
+
+	worker := func() (bool, error) {
+
+		summaries, err := c.unitSummaries(unitNames)
+		if err != nil {
+			c.logger().Warnf("Failed to get unit states: %v.  Will retry", err)
+			return false, nil
+		}
+
+		allRunning := true
+		for _, summary := range summaries {
+
+			if summary != lastReported[summary.Name] {
+				c.logger().Infof(
+					"Unit %v on machine %v (%v): %v/%v",
+					summary.Name,
+					summary.MachineIP,
+					summary.MachineID,
+					summary.ActiveState,
+					summary.SubState,
+				)
+				lastReported[summary.Name] = summary
+			}
+
+			if summary.ActiveState == "failed" {
+				return false, fmt.Errorf("Unit %v failed on machine %v", summary.Name, summary.MachineIP)
+			}
+			if summary.ActiveState != "active" || summary.SubState != "running" {
+				allRunning = false
+			}
+
+		}
+
+		return allRunning, nil
+
+	}
+
+	sleeper := func(numAttempts int) (bool, int) {
+		if numAttempts > MAX_RETRIES_UNITS_ACTIVE {
+			return false, -1
+		}
+		return true, 5
+	}
+
+	err := RetryLoop(worker, sleeper)
+
+	c.logUnitSummary(unitNames)
+
+	return err
+
+}
+
+func (c CouchbaseFleet) logUnitSummary(unitNames []string) {
+
+	summaries, err := c.unitSummaries(unitNames)
+	if err != nil {
+		c.logger().Warnf("Unable to get unit summary: %v", err)
+		return
+	}
+
+	c.logger().Infof("Unit summary:")
+	for _, summary := range summaries {
+		c.logger().Infof(
+			"  %-30v machine: %-16v active: %-12v sub: %v",
+			summary.Name,
+			summary.MachineIP,
+			summary.ActiveState,
+			summary.SubState,
+		)
+	}
+
+}
@@ -0,0 +1,402 @@
+package cbcluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	KEY_UPGRADE_STATE          = "/couchbase.com/upgrade"
+	MAX_RETRIES_UPGRADE_NODE   = 180
+	UPGRADE_STATUS_IN_PROGRESS = "in-progress"
+	UPGRADE_STATUS_FAILED      = "failed"
+	UPGRADE_STATUS_DONE        = "done"
+)
+
+// Progress of a rolling upgrade, stored in etcd under /couchbase.com/upgrade
+// so that a failed or interrupted upgrade can be resumed.
+type UpgradeState struct {
+	Version      string    `json:"version"`
+	ContainerTag string    `json:"containerTag"`
+	Status       string    `json:"status"`
+	Completed    []int     `json:"completed"` // unit numbers already upgraded
+	Current      int       `json:"current"`   // unit number being upgraded, or 0
+	NumNodes     int       `json:"numNodes"`  // number of nodes when the upgrade started
+	Error        string    `json:"error,omitempty"`
+	Updated      time.Time `json:"updated"`
+}
+
+func (state UpgradeState) isCompleted(unitNumber int) bool {
+	return containsInt(state.Completed, unitNumber)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Upgrade every couchbase_node unit to c.CbVersion / c.ContainerTag, one
+// unit at a time.  Each node is rebalanced out, its unit replaced with a
+// copy running the new image, and then we wait until the replacement has
+// joined and the cluster is healthy before moving on.  Stops at the first
+// failure, and picks up where it left off when run again.
+func (c CouchbaseFleet) Upgrade() error {
+
+	state, err := c.loadUpgradeState()
+	if err != nil {
+		return err
+	}
+
+	unitNumbers, err := c.couchbaseUnitNumbers()
+	if err != nil {
+		return err
+	}
+	if len(unitNumbers) == 0 {
+		return fmt.Errorf("No couchbase_node units found.  Use launch-cbs to launch a cluster first")
+	}
+
+	fleetUnitJson, err := c.upgradedFleetUnitJson(unitNumbers[len(unitNumbers)-1])
+	if err != nil {
+		return err
+	}
+
+	// an upgrade interrupted after destroying the current unit, but before
+	// submitting its replacement, left it out of fleet
+	if state.Current != 0 && !containsInt(unitNumbers, state.Current) {
+		c.logger().Infof("Unit %v was destroyed by the interrupted upgrade, resubmitting it", state.Current)
+		unitNumbers = append(unitNumbers, state.Current)
+		sort.Ints(unitNumbers)
+	}
+
+	if state.NumNodes == 0 {
+		state.NumNodes = len(unitNumbers)
+	}
+	if state.NumNodes < 2 {
+		return fmt.Errorf("Rolling upgrade needs at least 2 nodes, found %v", state.NumNodes)
+	}
+
+	couchbaseCluster := NewCouchbaseCluster(c.EtcdServers)
+	if err := couchbaseCluster.LoadAdminCredsFromEtcd(); err != nil {
+		return err
+	}
+	StupidPortHack(couchbaseCluster)
+
+	for _, unitNumber := range unitNumbers {
+
+		if state.isCompleted(unitNumber) {
+			c.logger().Infof("Unit %v already upgraded, skipping", unitNumber)
+			continue
+		}
+
+		state.Current = unitNumber
+		if err := c.saveUpgradeState(state); err != nil {
+			return err
+		}
+
+		if err := c.upgradeUnit(couchbaseCluster, unitNumber, state.NumNodes, fleetUnitJson); err != nil {
+			state.Status = UPGRADE_STATUS_FAILED
+			state.Error = err.Error()
+			if saveErr := c.saveUpgradeState(state); saveErr != nil {
+				c.logger().Warnf("Failed to save upgrade state: %v", saveErr)
+			}
+			return fmt.Errorf("Upgrade of unit %v failed, fix the problem and run upgrade again to resume: %v", unitNumber, err)
+		}
+
+		state.Completed = append(state.Completed, unitNumber)
+		state.Current = 0
+		if err := c.saveUpgradeState(state); err != nil {
+			return err
+		}
+
+	}
+
+	state.Status = UPGRADE_STATUS_DONE
+	if err := c.saveUpgradeState(state); err != nil {
+		return err
+	}
+
+	c.logger().Infof("Cluster upgraded to %v:%v", c.CbVersion, c.ContainerTag)
+
+	return nil
+
+}
+
+func (c CouchbaseFleet) upgradeUnit(couchbaseCluster *CouchbaseCluster, unitNumber, numNodes int, fleetUnitJson string) error {
+
+	unitName := couchbaseUnitName(unitNumber)
+
+	c.logger().Infof("Upgrading unit: %v", unitName)
+
+	// when resuming, the unit may already have been replaced
+	upToDate, err := c.fleetUnitMatches(unitName, fleetUnitJson)
+	if err != nil {
+		return err
+	}
+
+	if !upToDate {
+
+		unitIps, err := c.fleetUnitMachineIps()
+		if err != nil {
+			return err
+		}
+
+		if nodeIp, ok := unitIps[unitName]; ok {
+			liveNodeIp, err := findLiveNodeExcept(couchbaseCluster, nodeIp)
+			if err != nil {
+				return err
+			}
+			if err := couchbaseCluster.RebalanceOutNodes(liveNodeIp, []string{nodeIp}); err != nil {
+				return err
+			}
+		}
+
+		// when resuming, the unit may already have been destroyed
+		existing, err := c.fleetClient.Unit(unitName)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			if err := c.fleetClient.DestroyUnit(unitName); err != nil {
+				return err
+			}
+			if err := c.waitUntilUnitsGone([]string{unitName}); err != nil {
+				return err
+			}
+		}
+		if err := c.submitAndLaunchFleetUnitN(unitNumber, fleetUnitJson); err != nil {
+			return err
+		}
+
+	}
+
+	if err := c.waitUntilUnitsActive([]string{unitName}); err != nil {
+		return err
+	}
+
+	c.logger().Infof("Waiting for %v to join and for the cluster to be healthy", unitName)
+	return waitUntilNumActiveNodes(couchbaseCluster, numNodes)
+
+}
+
+// The unit json to replace the existing units with.  Unless a template was
+// given, this is the highest numbered existing unit with only its docker
+// image swapped, so the data volume, env, memory limit, placement and other
+// options of the original launch carry over, like they do in Scale.
+func (c CouchbaseFleet) upgradedFleetUnitJson(unitNumber int) (string, error) {
+
+	if c.UnitTemplate != "" {
+		return c.generateFleetUnitJson()
+	}
+
+	existingUnitJson, err := c.getFleetUnitJson(couchbaseUnitName(unitNumber))
+	if err != nil {
+		return "", err
+	}
+
+	return replaceFleetUnitImage(existingUnitJson, c.fleetParams().IMAGE)
+
+}
+
+// Replace the image pulled by the unit's "docker pull" with image, everywhere
+// it appears in the unit options as a word of its own, so that longer words
+// containing it (ie, repo:10 for repo:1, or couchbase-cluster) are left alone.
+func replaceFleetUnitImage(fleetUnitJson, image string) (string, error) {
+
+	fleetUnit := FleetUnit{}
+	if err := json.Unmarshal([]byte(fleetUnitJson), &fleetUnit); err != nil {
+		return "", err
+	}
+
+	oldImage := ""
+	for _, option := range fleetUnit.Options {
+		fields := strings.Fields(option.Value)
+		if option.Name == "ExecStartPre" && len(fields) == 3 && strings.HasSuffix(fields[0], "docker") && fields[1] == "pull" {
+			oldImage = fields[2]
+			break
+		}
+	}
+	if oldImage == "" {
+		return "", fmt.Errorf("Unable to find the docker image of the existing units.  Use --template to give the unit to upgrade to")
+	}
+
+	options := []FleetUnitOption{}
+	for _, option := range fleetUnit.Options {
+		option.Value = replaceWord(option.Value, oldImage, image)
+		options = append(options, option)
+	}
+
+	newUnitJson, err := json.Marshal(FleetUnit{DesiredState: "launched", Options: options})
+	if err != nil {
+		return "", err
+	}
+
+	if err := validateFleetUnitJson(string(newUnitJson)); err != nil {
+		return "", err
+	}
+
+	return string(newUnitJson), nil
+
+}
+
+// Replace each occurrence of word in s that is delimited by whitespace,
+// quotes or the ends of s.
+func replaceWord(s, word, replacement string) string {
+
+	isDelimiter := func(i int) bool {
+		return i < 0 || i >= len(s) || strings.ContainsRune(" \t'\"", rune(s[i]))
+	}
+
+	replaced := &bytes.Buffer{}
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], word) && isDelimiter(i-1) && isDelimiter(i+len(word)) {
+			replaced.WriteString(replacement)
+			i += len(word)
+			continue
+		}
+		replaced.WriteByte(s[i])
+		i += 1
+	}
+	return replaced.String()
+
+}
+
+// Wait until numNodes nodes are healthy active members and no rebalance is running.
+func waitUntilNumActiveNodes(couchbaseCluster *CouchbaseCluster, numNodes int) error {
+
+	worker := func() (bool, error) {
+
+		liveNodeIp, err := couchbaseCluster.FindLiveNode()
+		if err != nil || liveNodeIp == "" {
+			defaultLogger.Warnf("FindLiveNode returned err: %v or empty ip", err)
+			return false, nil
+		}
+
+		numActive, err := couchbaseCluster.CountActiveHealthyNodes(liveNodeIp)
+		if err != nil || numActive < numNodes {
+			defaultLogger.Infof("Waiting for %v active nodes, have %v.  err: %v", numNodes, numActive, err)
+			return false, nil
+		}
+
+		isRebalancing, err := couchbaseCluster.IsRebalancing(liveNodeIp)
+		if err != nil || isRebalancing {
+			defaultLogger.Infof("Waiting for rebalance to finish.  err: %v", err)
+			return false, nil
+		}
+
+		return true, nil
+
+	}
+
+	sleeper := func(numAttempts int) (bool, int) {
+		if numAttempts > MAX_RETRIES_UPGRADE_NODE {
+			return false, -1
+		}
+		return true, 10
+	}
+
+	return RetryLoop(worker, sleeper)
+
+}
+
+// Find a live node other than exceptIp
+func findLiveNodeExcept(couchbaseCluster *CouchbaseCluster, exceptIp string) (string, error) {
+
+	liveNodeIps, err := couchbaseCluster.FindLiveNodes()
+	if err != nil {
+		return "", err
+	}
+
+	for _, liveNodeIp := range liveNodeIps {
+		if liveNodeIp != exceptIp {
+			return liveNodeIp, nil
+		}
+	}
+
+	return "", fmt.Errorf("No live node found other than %v", exceptIp)
+
+}
+
+// Does the existing unit have the same options as fleetUnitJson?
+func (c CouchbaseFleet) fleetUnitMatches(unitName, fleetUnitJson string) (bool, error) {
+
+	existing, err := c.fleetClient.Unit(unitName)
+	if err != nil || existing == nil {
+		return false, err
+	}
+
+	desired := FleetUnit{}
+	if err := json.Unmarshal([]byte(fleetUnitJson), &desired); err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(existing.Options, desired.Options), nil
+
+}
+
+// Get the upgrade state to continue from.  A finished upgrade, or none at
+// all, means starting over.  An unfinished upgrade to a different version
+// is an error, since mixing three versions in one cluster is asking for trouble.
+func (c CouchbaseFleet) loadUpgradeState() (UpgradeState, error) {
+
+	newState := UpgradeState{
+		Version:      c.CbVersion,
+		ContainerTag: c.ContainerTag,
+		Status:       UPGRADE_STATUS_IN_PROGRESS,
+		Completed:    []int{},
+	}
+
+	response, err := c.etcdClient.Get(KEY_UPGRADE_STATE, false, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "Key not found") {
+			return newState, nil
+		}
+		return UpgradeState{}, err
+	}
+
+	state := UpgradeState{}
+	if err := json.Unmarshal([]byte(response.Node.Value), &state); err != nil {
+		return UpgradeState{}, err
+	}
+
+	if state.Status == UPGRADE_STATUS_DONE {
+		return newState, nil
+	}
+
+	if state.Version != c.CbVersion || state.ContainerTag != c.ContainerTag {
+		return UpgradeState{}, fmt.Errorf(
+			"An upgrade to %v:%v is unfinished.  Resume that one first",
+			state.Version,
+			state.ContainerTag,
+		)
+	}
+
+	c.logger().Infof("Resuming upgrade, already upgraded units: %v", state.Completed)
+
+	state.Status = UPGRADE_STATUS_IN_PROGRESS
+	state.Error = ""
+	return state, nil
+
+}
+
+func (c CouchbaseFleet) saveUpgradeState(state UpgradeState) error {
+
+	state.Updated = time.Now().UTC()
+
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.etcdClient.Set(KEY_UPGRADE_STATE, string(stateJson), TTL_NONE)
+	return err
+
+}
@@ -0,0 +1,106 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplaceFleetUnitImage(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		options  []FleetUnitOption
+		image    string
+		expected []string // the option values after the replacement
+	}{
+		{
+			name: "default unit",
+			options: []FleetUnitOption{
+				{Section: "Service", Name: "ExecStartPre", Value: "/usr/bin/docker pull tleyden5iwx/couchbase-server-3.0.1:latest"},
+				{Section: "Service", Name: "ExecStart", Value: "/bin/bash -c '/usr/bin/docker run --name couchbase -v /opt/couchbase/var:/opt/couchbase/var --net=host tleyden5iwx/couchbase-server-3.0.1:latest couchbase-cluster start-couchbase-node'"},
+				{Section: "X-Fleet", Name: "MachineMetadata", Value: "role=couchbase"},
+			},
+			image: "tleyden5iwx/couchbase-server-3.0.2:v2",
+			expected: []string{
+				"/usr/bin/docker pull tleyden5iwx/couchbase-server-3.0.2:v2",
+				"/bin/bash -c '/usr/bin/docker run --name couchbase -v /opt/couchbase/var:/opt/couchbase/var --net=host tleyden5iwx/couchbase-server-3.0.2:v2 couchbase-cluster start-couchbase-node'",
+				"role=couchbase",
+			},
+		},
+		{
+			name: "image inside other words",
+			options: []FleetUnitOption{
+				{Section: "Service", Name: "ExecStartPre", Value: "docker pull couchbase"},
+				{Section: "Service", Name: "ExecStart", Value: "docker run --name couchbase-node -e IMAGE=couchbase:old couchbase couchbase-cluster"},
+			},
+			image: "couchbase:4.0",
+			expected: []string{
+				"docker pull couchbase:4.0",
+				"docker run --name couchbase-node -e IMAGE=couchbase:old couchbase:4.0 couchbase-cluster",
+			},
+		},
+		{
+			name: "image at the end of a quoted command",
+			options: []FleetUnitOption{
+				{Section: "Service", Name: "ExecStartPre", Value: "/usr/bin/docker pull repo:1"},
+				{Section: "Service", Name: "ExecStart", Value: "/bin/sh -c 'docker run repo:1' repo:10"},
+			},
+			image: "repo:2",
+			expected: []string{
+				"/usr/bin/docker pull repo:2",
+				"/bin/sh -c 'docker run repo:2' repo:10",
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		unitJson, _ := json.Marshal(FleetUnit{
+			Name:         "couchbase_node@1.service",
+			DesiredState: "launched",
+			CurrentState: "launched",
+			MachineID:    "a91c",
+			Options:      test.options,
+		})
+
+		newUnitJson, err := replaceFleetUnitImage(string(unitJson), test.image)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		newUnit := FleetUnit{}
+		if err := json.Unmarshal([]byte(newUnitJson), &newUnit); err != nil {
+			t.Fatal(err)
+		}
+		if newUnit.Name != "" || newUnit.MachineID != "" || newUnit.CurrentState != "" || newUnit.DesiredState != "launched" {
+			t.Errorf("%v: expected a new unit to launch, got: %+v", test.name, newUnit)
+		}
+
+		values := []string{}
+		for i, option := range newUnit.Options {
+			values = append(values, option.Value)
+			if option.Section != test.options[i].Section || option.Name != test.options[i].Name {
+				t.Errorf("%v: option %v changed from %+v to %+v", test.name, i, test.options[i], option)
+			}
+		}
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%v: expected option values %q, got %q", test.name, test.expected, values)
+		}
+
+	}
+
+}
+
+func TestReplaceFleetUnitImageWithoutDockerPull(t *testing.T) {
+
+	unitJson := `{"desiredState":"launched","options":[{"section":"Service","name":"ExecStart","value":"docker run couchbase"}]}`
+
+	_, err := replaceFleetUnitImage(unitJson, "couchbase:4.0")
+	if err == nil || !strings.Contains(err.Error(), "--template") {
+		t.Fatalf("Expected an error pointing at --template, got: %v", err)
+	}
+
+}
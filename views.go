@@ -0,0 +1,263 @@
+package cbcluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	KEY_DESIGN_DOCS     = "/couchbase.com/design-docs"
+	COUCHBASE_VIEW_PORT = "8092"
+	DEFAULT_BUCKET_NAME = "default"
+)
+
+// A design document, where Name is the part after _design/ (ie, "dev_users")
+// and Body is the raw json containing the "views" definitions.
+type DesignDoc struct {
+	Name string
+	Body []byte
+}
+
+// Load design docs from a directory, where each <name>.json file is
+// a single design document named after the file.
+func LoadDesignDocsFromDir(dir string) ([]DesignDoc, error) {
+
+	defaultLogger.Infof("LoadDesignDocsFromDir() called with: %v", dir)
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	designDocs := []DesignDoc{}
+
+	for _, fileInfo := range fileInfos {
+
+		if fileInfo.IsDir() || filepath.Ext(fileInfo.Name()) != ".json" {
+			continue
+		}
+
+		body, err := ioutil.ReadFile(filepath.Join(dir, fileInfo.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(fileInfo.Name(), ".json")
+		designDoc, err := NewDesignDoc(name, body)
+		if err != nil {
+			return nil, err
+		}
+		designDocs = append(designDocs, designDoc)
+
+	}
+
+	return designDocs, nil
+
+}
+
+// Load design docs stored in etcd under /couchbase.com/design-docs/<name>.
+// If that key does not exist, an empty list is returned.
+func (c CouchbaseCluster) LoadDesignDocsFromEtcd() ([]DesignDoc, error) {
+
+	c.logger().Infof("LoadDesignDocsFromEtcd()")
+
+	designDocs := []DesignDoc{}
+
+	nodes, err := c.etcdChildren(KEY_DESIGN_DOCS)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subNode := range nodes {
+
+		_, name := path.Split(subNode.Key)
+		designDoc, err := NewDesignDoc(name, []byte(subNode.Value))
+		if err != nil {
+			return nil, err
+		}
+		designDocs = append(designDocs, designDoc)
+
+	}
+
+	return designDocs, nil
+
+}
+
+func NewDesignDoc(name string, body []byte) (DesignDoc, error) {
+
+	name = strings.TrimPrefix(name, "_design/")
+	if name == "" {
+		return DesignDoc{}, fmt.Errorf("Design doc has an empty name")
+	}
+
+	jsonMap := map[string]interface{}{}
+	if err := json.Unmarshal(body, &jsonMap); err != nil {
+		return DesignDoc{}, fmt.Errorf("Invalid json in design doc %v: %v", name, err)
+	}
+
+	return DesignDoc{Name: name, Body: body}, nil
+
+}
+
+// Create or update the given design docs on bucket, connecting to the
+// view port of liveNodeIp.  Design docs that are identical to the ones
+// already on the bucket are skipped.  Returns the names of the design
+// docs that were created or updated.
+func (c CouchbaseCluster) ApplyDesignDocs(liveNodeIp, bucket string, designDocs []DesignDoc) ([]string, error) {
+
+	c.logger().Infof("ApplyDesignDocs() called with: %v", liveNodeIp)
+
+	changed := []string{}
+
+	for _, designDoc := range designDocs {
+
+		endpointUrl := fmt.Sprintf(
+			"http://%v:%v/%v/_design/%v",
+			liveNodeIp,
+			COUCHBASE_VIEW_PORT,
+			bucket,
+			designDoc.Name,
+		)
+
+		unchanged, err := c.designDocUnchanged(endpointUrl, designDoc)
+		if err != nil {
+			return changed, err
+		}
+		if unchanged {
+			c.logger().Infof("Design doc %v unchanged, skipping", designDoc.Name)
+			continue
+		}
+
+		c.logger().Infof("Putting design doc %v to %v", designDoc.Name, endpointUrl)
+		if err := c.PUT(endpointUrl, "application/json", designDoc.Body); err != nil {
+			return changed, err
+		}
+		changed = append(changed, designDoc.Name)
+
+	}
+
+	return changed, nil
+
+}
+
+// Does the design doc at endpointUrl have the same content as designDoc?
+// A design doc that does not exist yet is never unchanged.
+func (c CouchbaseCluster) designDocUnchanged(endpointUrl string, designDoc DesignDoc) (bool, error) {
+
+	existing := map[string]interface{}{}
+	statusCode, err := c.getJsonDataStatus(endpointUrl, &existing)
+	if err != nil {
+		return false, err
+	}
+	if statusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	desired := map[string]interface{}{}
+	if err := json.Unmarshal(designDoc.Body, &desired); err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(existing, desired), nil
+
+}
+
+// Apply the design docs found in c.DesignDocDir, or in etcd if no
+// directory was given, to the default bucket on the local node.
+func (c CouchbaseCluster) ApplyInitialDesignDocs() error {
+
+	var designDocs []DesignDoc
+	var err error
+
+	if c.DesignDocDir != "" {
+		designDocs, err = LoadDesignDocsFromDir(c.DesignDocDir)
+	} else {
+		designDocs, err = c.LoadDesignDocsFromEtcd()
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(designDocs) == 0 {
+		c.logger().Infof("No design docs to apply")
+		return nil
+	}
+
+	if err := c.WaitUntilBucketReady(c.LocalCouchbaseIp, DEFAULT_BUCKET_NAME); err != nil {
+		return err
+	}
+
+	changed, err := c.ApplyDesignDocs(c.LocalCouchbaseIp, DEFAULT_BUCKET_NAME, designDocs)
+	if err != nil {
+		return err
+	}
+
+	c.logger().Infof("Design docs changed: %v", changed)
+	return nil
+
+}
+
+func (c CouchbaseCluster) PUT(endpointUrl, contentType string, body []byte) error {
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("PUT", endpointUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth(c.AdminUsername, c.AdminPassword)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf(
+			"Failed to PUT to %v.  Status code: %v.  Body: %v",
+			endpointUrl,
+			resp.StatusCode,
+			string(respBody),
+		)
+	}
+
+	return nil
+
+}
+
+// Connect to etcd, find a live node and apply the design docs found in
+// designDocDir (or in etcd if designDocDir is empty) to bucket.
+func ApplyDesignDocsToCluster(etcdServers []string, designDocDir, bucket string) ([]string, error) {
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(etcdServers)
+	if err != nil {
+		return nil, err
+	}
+
+	var designDocs []DesignDoc
+	if designDocDir != "" {
+		designDocs, err = LoadDesignDocsFromDir(designDocDir)
+	} else {
+		designDocs, err = couchbaseCluster.LoadDesignDocsFromEtcd()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return couchbaseCluster.ApplyDesignDocs(liveNodeIp, bucket, designDocs)
+
+}
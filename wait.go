@@ -0,0 +1,199 @@
+package cbcluster
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	WAIT_TIMEOUT          = "timeout"
+	WAIT_AUTH_FAILED      = "auth-failed"
+	WAIT_ETCD_UNREACHABLE = "etcd-unreachable"
+
+	WAIT_POLL_SECONDS = 10
+
+	// an uninitialized node briefly rejects the admin credentials, so only
+	// give up after they are rejected this many times in a row
+	WAIT_MAX_AUTH_FAILURES = 3
+
+	// etcd being down for a few minutes is not going to resolve itself
+	// soon, so give up after this many unreachable attempts in a row even
+	// without a timeout
+	WAIT_MAX_ETCD_UNREACHABLE = 30
+)
+
+// What to wait for.  A zero Timeout waits forever, a zero NumNodes waits
+// for all the nodes in the cluster, and an empty Bucket skips waiting for
+// a bucket.
+type WaitOptions struct {
+	Timeout  time.Duration
+	NumNodes int
+	Bucket   string
+}
+
+// Returned by WaitUntilRunning, so that callers can tell why it gave up.
+// Reason is one of WAIT_TIMEOUT, WAIT_AUTH_FAILED or WAIT_ETCD_UNREACHABLE.
+type WaitError struct {
+	Reason string
+	Err    error
+}
+
+func (e WaitError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Reason, e.Err)
+}
+
+// Wait until all nodes of the cluster are running and healthy
+func WaitUntilCBClusterRunning(etcdServers []string) error {
+	return WaitUntilRunning(etcdServers, WaitOptions{})
+}
+
+// Wait until at least numNodes nodes of the cluster are running and healthy
+func WaitUntilNumNodesRunning(numNodes int, etcdServers []string) error {
+	return WaitUntilRunning(etcdServers, WaitOptions{NumNodes: numNodes})
+}
+
+// Poll etcd and the cluster until the nodes, and the bucket if one is
+// given, are up and healthy.  Anything that may still resolve itself, such
+// as couchbase not answering yet, is retried until the timeout.  An
+// unreachable etcd is retried until the timeout or until it failed
+// WAIT_MAX_ETCD_UNREACHABLE times in a row, whichever comes first.
+func WaitUntilRunning(etcdServers []string, options WaitOptions) error {
+
+	couchbaseCluster := NewCouchbaseCluster(etcdServers)
+	StupidPortHack(couchbaseCluster)
+
+	return couchbaseCluster.waitUntilRunning(options)
+
+}
+
+func (c *CouchbaseCluster) waitUntilRunning(options WaitOptions) error {
+
+	deadline := time.Time{}
+	if options.Timeout > 0 {
+		deadline = time.Now().Add(options.Timeout)
+	}
+
+	numNodes := options.NumNodes
+	if numNodes <= 0 {
+		numNodes = -1 // all of them
+	}
+
+	var lastErr error
+	etcdUnreachable := false
+	etcdUnreachableAttempts := 0
+	authFailures := 0
+
+	// returns a WaitError once etcd was unreachable too many times in a row
+	checkEtcdUnreachable := func(err error) error {
+		etcdUnreachable = isEtcdUnreachable(err)
+		if !etcdUnreachable {
+			etcdUnreachableAttempts = 0
+			return nil
+		}
+		etcdUnreachableAttempts += 1
+		if etcdUnreachableAttempts >= WAIT_MAX_ETCD_UNREACHABLE {
+			return WaitError{
+				Reason: WAIT_ETCD_UNREACHABLE,
+				Err:    fmt.Errorf("Etcd was unreachable %v times in a row: %v", etcdUnreachableAttempts, err),
+			}
+		}
+		return nil
+	}
+
+	worker := func() (bool, error) {
+
+		// the credentials are not in etcd until the cluster is launched
+		if _, err := c.ReloadAdminCredsEtcd(); err != nil {
+			if waitErr := checkEtcdUnreachable(err); waitErr != nil {
+				return false, waitErr
+			}
+			lastErr = fmt.Errorf("Unable to get admin credentials from etcd: %v", err)
+			c.logger().Infof("%v", lastErr)
+			return false, nil
+		}
+
+		liveNodeIp, err := c.FindLiveNode()
+		if waitErr := checkEtcdUnreachable(err); waitErr != nil {
+			return false, waitErr
+		}
+		if err != nil || liveNodeIp == "" {
+			lastErr = fmt.Errorf("No live node found in etcd (err: %v)", err)
+			c.logger().Infof("%v", lastErr)
+			return false, nil
+		}
+
+		accepted, err := c.credsAccepted(liveNodeIp, c.AdminUsername, c.AdminPassword)
+		if err != nil {
+			lastErr = fmt.Errorf("Node %v is not answering: %v", liveNodeIp, err)
+			c.logger().Infof("%v", lastErr)
+			return false, nil
+		}
+		if !accepted {
+			authFailures += 1
+			if authFailures >= WAIT_MAX_AUTH_FAILURES {
+				return false, WaitError{
+					Reason: WAIT_AUTH_FAILED,
+					Err:    fmt.Errorf("Node %v rejected the admin credentials of user %v", liveNodeIp, c.AdminUsername),
+				}
+			}
+			lastErr = fmt.Errorf("Node %v rejected the admin credentials", liveNodeIp)
+			c.logger().Warnf("%v", lastErr)
+			return false, nil
+		}
+		authFailures = 0
+
+		ok, err := c.CheckNumNodesClusterHealthy(numNodes, liveNodeIp)
+		if err != nil || !ok {
+			lastErr = fmt.Errorf("Cluster nodes are not all up and healthy (err: %v)", err)
+			c.logger().Infof("%v", lastErr)
+			return false, nil
+		}
+
+		if options.Bucket != "" {
+			ok, err := c.checkBucketReady(liveNodeIp, options.Bucket)
+			if err != nil || !ok {
+				lastErr = fmt.Errorf("Bucket %v is not ready (err: %v)", options.Bucket, err)
+				return false, nil
+			}
+		}
+
+		return true, nil
+
+	}
+
+	sleeper := func(numAttempts int) (bool, int) {
+		if deadline.IsZero() {
+			return true, WAIT_POLL_SECONDS
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return false, -1
+		}
+		if remaining < WAIT_POLL_SECONDS*time.Second {
+			return true, int(remaining/time.Second) + 1
+		}
+		return true, WAIT_POLL_SECONDS
+	}
+
+	err := RetryLoop(worker, sleeper)
+	if _, ok := err.(WaitError); ok || err == nil {
+		return err
+	}
+
+	// the sleeper gave up, so the deadline passed
+	if etcdUnreachable {
+		return WaitError{Reason: WAIT_ETCD_UNREACHABLE, Err: lastErr}
+	}
+	return WaitError{
+		Reason: WAIT_TIMEOUT,
+		Err:    fmt.Errorf("Cluster not running after %v.  Last error: %v", options.Timeout, lastErr),
+	}
+
+}
+
+// Did etcd fail to answer at all, as opposed to answering with an error
+// such as "Key not found"?
+func isEtcdUnreachable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "All the given peers are not reachable")
+}
@@ -0,0 +1,484 @@
+package cbcluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	KEY_XDCR_SPECS = "/couchbase.com/xdcr/specs"
+	KEY_XDCR_STATE = "/couchbase.com/xdcr/state"
+
+	// couchbase adds it to remote cluster hostnames that have no port
+	DEFAULT_REMOTE_CLUSTER_PORT = "8091"
+)
+
+// An XDCR replication as stored in etcd under /couchbase.com/xdcr/specs/<name>.
+// Several specs can share the same remote cluster, as long as they agree
+// on its hostname and credentials.
+type XdcrSpec struct {
+	Name         string `json:"-"`
+	RemoteName   string `json:"remoteName"`
+	Hostname     string `json:"hostname"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	SourceBucket string `json:"sourceBucket"`
+	TargetBucket string `json:"targetBucket"`
+	Filter       string `json:"filter,omitempty"`
+}
+
+// What we created for a spec, stored under /couchbase.com/xdcr/state/<name>
+// so that it can be removed once the spec is deleted.
+type XdcrState struct {
+	RemoteName    string `json:"remoteName"`
+	ReplicationId string `json:"replicationId"`
+}
+
+type XdcrStatus struct {
+	Name          string        `json:"name"`
+	ReplicationId string        `json:"replicationId"`
+	Status        string        `json:"status"` // ie, running, paused or notCreated
+	ChangesLeft   float64       `json:"changesLeft"`
+	Errors        []interface{} `json:"errors"`
+}
+
+func (spec XdcrSpec) Validate() error {
+
+	if spec.RemoteName == "" || spec.Hostname == "" {
+		return fmt.Errorf("XDCR spec %v needs a remoteName and hostname", spec.Name)
+	}
+	if spec.SourceBucket == "" || spec.TargetBucket == "" {
+		return fmt.Errorf("XDCR spec %v needs a sourceBucket and targetBucket", spec.Name)
+	}
+	return nil
+
+}
+
+// Find the XDCR specs in etcd, keyed by spec name
+func (c CouchbaseCluster) XdcrSpecsEtcd() (map[string]XdcrSpec, error) {
+
+	specs := map[string]XdcrSpec{}
+
+	nodes, err := c.etcdChildren(KEY_XDCR_SPECS)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+
+		_, name := path.Split(node.Key)
+
+		spec := XdcrSpec{}
+		if err := json.Unmarshal([]byte(node.Value), &spec); err != nil {
+			return nil, fmt.Errorf("Invalid XDCR spec %v: %v", name, err)
+		}
+		RegisterSecret(spec.Password)
+		spec.Name = name
+		if err := spec.Validate(); err != nil {
+			return nil, err
+		}
+		specs[name] = spec
+
+	}
+
+	return specs, nil
+
+}
+
+// Find the XDCR state records in etcd, keyed by spec name
+func (c CouchbaseCluster) XdcrStatesEtcd() (map[string]XdcrState, error) {
+
+	states := map[string]XdcrState{}
+
+	nodes, err := c.etcdChildren(KEY_XDCR_STATE)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+
+		_, name := path.Split(node.Key)
+
+		state := XdcrState{}
+		if err := json.Unmarshal([]byte(node.Value), &state); err != nil {
+			return nil, fmt.Errorf("Invalid XDCR state %v: %v", name, err)
+		}
+		states[name] = state
+
+	}
+
+	return states, nil
+
+}
+
+// Make the remote clusters and replications on the cluster match the
+// specs in etcd.  Replications (and remote clusters no longer used by any
+// spec) that were created for a spec that has since been deleted are removed.
+func (c CouchbaseCluster) ApplyXdcrSpecs(liveNodeIp string) error {
+
+	c.logger().Infof("ApplyXdcrSpecs()")
+
+	specs, err := c.XdcrSpecsEtcd()
+	if err != nil {
+		return err
+	}
+
+	states, err := c.XdcrStatesEtcd()
+	if err != nil {
+		return err
+	}
+
+	for name, state := range states {
+		if _, ok := specs[name]; ok {
+			continue
+		}
+		if err := c.removeXdcr(liveNodeIp, name, state, specs); err != nil {
+			return err
+		}
+	}
+
+	for name, spec := range specs {
+		if err := c.applyXdcrSpec(liveNodeIp, spec, states[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (c CouchbaseCluster) applyXdcrSpec(liveNodeIp string, spec XdcrSpec, state XdcrState) error {
+
+	c.logger().Infof("Applying XDCR spec: %v", spec.Name)
+
+	remoteUuid, err := c.ensureRemoteCluster(liveNodeIp, spec)
+	if err != nil {
+		return err
+	}
+
+	replicationId := strings.Join([]string{remoteUuid, spec.SourceBucket, spec.TargetBucket}, "/")
+
+	tasks, err := c.XdcrTasks(liveNodeIp)
+	if err != nil {
+		return err
+	}
+
+	// the filter of an existing replication can't be changed, so if it
+	// differs, the replication is recreated.
+	if task, ok := tasks[replicationId]; ok {
+		filter, _ := task["filterExpression"].(string)
+		if filter == spec.Filter {
+			c.logger().Infof("Replication %v already exists", replicationId)
+			return c.setXdcrStateEtcd(spec.Name, XdcrState{spec.RemoteName, replicationId})
+		}
+		if err := c.cancelReplication(liveNodeIp, replicationId); err != nil {
+			return err
+		}
+	}
+
+	// if the spec used to point somewhere else, get rid of the old replication
+	if state.ReplicationId != "" && state.ReplicationId != replicationId {
+		if _, ok := tasks[state.ReplicationId]; ok {
+			if err := c.cancelReplication(liveNodeIp, state.ReplicationId); err != nil {
+				return err
+			}
+		}
+	}
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/controller/createReplication", liveNodeIp, c.LocalCouchbasePort)
+
+	data := url.Values{
+		"fromBucket":      {spec.SourceBucket},
+		"toCluster":       {spec.RemoteName},
+		"toBucket":        {spec.TargetBucket},
+		"replicationType": {"continuous"},
+	}
+	if spec.Filter != "" {
+		data.Set("filterExpression", spec.Filter)
+	}
+
+	body, err := c.POSTBody(false, endpointUrl, data)
+	if err != nil {
+		return err
+	}
+
+	// returns: {"id": "<remote uuid>/<from bucket>/<to bucket>"}
+	jsonMap := map[string]interface{}{}
+	if err := json.Unmarshal(body, &jsonMap); err != nil {
+		return err
+	}
+	createdId, ok := jsonMap["id"].(string)
+	if !ok {
+		return fmt.Errorf("No replication id in response: %v", string(body))
+	}
+
+	c.logger().Infof("Created replication %v", createdId)
+
+	return c.setXdcrStateEtcd(spec.Name, XdcrState{spec.RemoteName, createdId})
+
+}
+
+// Create the remote cluster reference for spec, or update it if the hostname
+// or credentials changed.  Returns the uuid of the remote cluster.
+func (c CouchbaseCluster) ensureRemoteCluster(liveNodeIp string, spec XdcrSpec) (string, error) {
+
+	remoteClusters, err := c.RemoteClusters(liveNodeIp)
+	if err != nil {
+		return "", err
+	}
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default/remoteClusters", liveNodeIp, c.LocalCouchbasePort)
+
+	remoteCluster, exists := remoteClusters[spec.RemoteName]
+	if exists {
+		// the password is never returned, so a password change alone goes unnoticed
+		remoteHostname, _ := remoteCluster["hostname"].(string)
+		if withDefaultPort(remoteHostname) == withDefaultPort(spec.Hostname) && remoteCluster["username"] == spec.Username {
+			uuid, _ := remoteCluster["uuid"].(string)
+			return uuid, nil
+		}
+		endpointUrl = fmt.Sprintf("%v/%v", endpointUrl, url.QueryEscape(spec.RemoteName))
+	}
+
+	data := url.Values{
+		"name":     {spec.RemoteName},
+		"hostname": {spec.Hostname},
+		"username": {spec.Username},
+		"password": {spec.Password},
+	}
+
+	c.logger().Infof("Creating or updating remote cluster %v at %v", spec.RemoteName, spec.Hostname)
+
+	body, err := c.POSTBody(false, endpointUrl, data)
+	if err != nil {
+		return "", err
+	}
+
+	jsonMap := map[string]interface{}{}
+	if err := json.Unmarshal(body, &jsonMap); err != nil {
+		return "", err
+	}
+	uuid, ok := jsonMap["uuid"].(string)
+	if !ok {
+		return "", fmt.Errorf("No uuid for remote cluster in response: %v", string(body))
+	}
+
+	return uuid, nil
+
+}
+
+func (c CouchbaseCluster) removeXdcr(liveNodeIp, name string, state XdcrState, specs map[string]XdcrSpec) error {
+
+	c.logger().Infof("XDCR spec %v was deleted, removing replication %v", name, state.ReplicationId)
+
+	tasks, err := c.XdcrTasks(liveNodeIp)
+	if err != nil {
+		return err
+	}
+	if _, ok := tasks[state.ReplicationId]; ok {
+		if err := c.cancelReplication(liveNodeIp, state.ReplicationId); err != nil {
+			return err
+		}
+	}
+
+	remoteStillUsed := false
+	for _, spec := range specs {
+		if spec.RemoteName == state.RemoteName {
+			remoteStillUsed = true
+		}
+	}
+
+	if !remoteStillUsed {
+		remoteClusters, err := c.RemoteClusters(liveNodeIp)
+		if err != nil {
+			return err
+		}
+		if _, ok := remoteClusters[state.RemoteName]; ok {
+			c.logger().Infof("Removing remote cluster %v", state.RemoteName)
+			endpointUrl := fmt.Sprintf(
+				"http://%v:%v/pools/default/remoteClusters/%v",
+				liveNodeIp,
+				c.LocalCouchbasePort,
+				url.QueryEscape(state.RemoteName),
+			)
+			if err := c.DELETE(endpointUrl); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = c.etcdClient.Delete(path.Join(KEY_XDCR_STATE, name), false)
+	return err
+
+}
+
+func (c CouchbaseCluster) cancelReplication(liveNodeIp, replicationId string) error {
+
+	c.logger().Infof("Cancelling replication %v", replicationId)
+
+	endpointUrl := fmt.Sprintf(
+		"http://%v:%v/controller/cancelXDCR/%v",
+		liveNodeIp,
+		c.LocalCouchbasePort,
+		url.QueryEscape(replicationId),
+	)
+
+	return c.DELETE(endpointUrl)
+
+}
+
+// Get the remote cluster references, keyed by name.  Deleted references
+// (which couchbase keeps around) are skipped.
+func (c CouchbaseCluster) RemoteClusters(liveNodeIp string) (map[string]map[string]interface{}, error) {
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default/remoteClusters", liveNodeIp, c.LocalCouchbasePort)
+
+	jsonList := []interface{}{}
+	if err := c.getJsonData(endpointUrl, &jsonList); err != nil {
+		return nil, err
+	}
+
+	remoteClusters := map[string]map[string]interface{}{}
+	for _, entry := range jsonList {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if deleted, _ := entryMap["deleted"].(bool); deleted {
+			continue
+		}
+		name, ok := entryMap["name"].(string)
+		if !ok {
+			continue
+		}
+		remoteClusters[name] = entryMap
+	}
+
+	return remoteClusters, nil
+
+}
+
+// Get the running XDCR replications from /pools/default/tasks, keyed by id
+func (c CouchbaseCluster) XdcrTasks(liveNodeIp string) (map[string]map[string]interface{}, error) {
+
+	endpointUrl := fmt.Sprintf("http://%v:%v/pools/default/tasks", liveNodeIp, c.LocalCouchbasePort)
+
+	jsonList := []interface{}{}
+	if err := c.getJsonData(endpointUrl, &jsonList); err != nil {
+		return nil, err
+	}
+
+	tasks := map[string]map[string]interface{}{}
+	for _, entry := range jsonList {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok || entryMap["type"] != "xdcr" {
+			continue
+		}
+		id, ok := entryMap["id"].(string)
+		if !ok {
+			continue
+		}
+		tasks[id] = entryMap
+	}
+
+	return tasks, nil
+
+}
+
+// Get the status of the replication for each spec in etcd
+func (c CouchbaseCluster) XdcrStatuses(liveNodeIp string) ([]XdcrStatus, error) {
+
+	specs, err := c.XdcrSpecsEtcd()
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := c.XdcrStatesEtcd()
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := c.XdcrTasks(liveNodeIp)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := []XdcrStatus{}
+	for _, name := range names {
+
+		status := XdcrStatus{
+			Name:          name,
+			ReplicationId: states[name].ReplicationId,
+			Status:        "notCreated",
+		}
+
+		if task, ok := tasks[status.ReplicationId]; ok {
+			status.Status, _ = task["status"].(string)
+			status.ChangesLeft, _ = task["changesLeft"].(float64)
+			status.Errors, _ = task["errors"].([]interface{})
+		}
+
+		statuses = append(statuses, status)
+
+	}
+
+	return statuses, nil
+
+}
+
+// Add the default port to a host without one, ie 10.0.0.1 -> 10.0.0.1:8091
+func withDefaultPort(hostname string) string {
+
+	if _, _, err := net.SplitHostPort(hostname); err == nil {
+		return hostname
+	}
+	return net.JoinHostPort(hostname, DEFAULT_REMOTE_CLUSTER_PORT)
+
+}
+
+func (c CouchbaseCluster) setXdcrStateEtcd(name string, state XdcrState) error {
+
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.etcdClient.Set(path.Join(KEY_XDCR_STATE, name), string(stateJson), TTL_NONE)
+	return err
+
+}
+
+// Connect to etcd and apply the XDCR specs stored there
+func ApplyXdcr(etcdServers []string) error {
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(etcdServers)
+	if err != nil {
+		return err
+	}
+
+	return couchbaseCluster.ApplyXdcrSpecs(liveNodeIp)
+
+}
+
+// Connect to etcd and get the status of each XDCR spec stored there
+func GetXdcrStatus(etcdServers []string) ([]XdcrStatus, error) {
+
+	couchbaseCluster, liveNodeIp, err := ConnectToLiveNode(etcdServers)
+	if err != nil {
+		return nil, err
+	}
+
+	return couchbaseCluster.XdcrStatuses(liveNodeIp)
+
+}